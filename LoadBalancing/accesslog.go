@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type AccessLogConfig struct {
+	Format     string `json:"format"`
+	Path       string `json:"path"`
+	MaxSizeMB  int    `json:"max_size_mb"`
+	MaxBackups int    `json:"max_backups"`
+	Buffer     int    `json:"buffer"`
+}
+
+var accessLogFormats = []string{"json", "common", "combined"}
+
+type accessEntry struct {
+	Time      time.Time
+	RequestID string
+	ClientIP  string
+	Method    string
+	Host      string
+	Path      string
+	Proto     string
+	Referer   string
+	UserAgent string
+	Pool      string
+	Backend   string
+	Status    int
+	BytesIn   int64
+	BytesOut  int64
+	Upstream  time.Duration
+	Total     time.Duration
+}
+
+// AccessLogger writes one line per request from a background goroutine.
+// When the queue is full, entries are dropped and counted rather than
+// slowing requests down.
+type AccessLogger struct {
+	format  string
+	out     io.WriteCloser
+	entries chan *accessEntry
+	dropped atomic.Uint64
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewAccessLogger(config AccessLogConfig) (*AccessLogger, error) {
+	if config.Format == "" {
+		config.Format = "common"
+	}
+	if config.Buffer <= 0 {
+		config.Buffer = 4096
+	}
+
+	var out io.WriteCloser = nopCloser{os.Stdout}
+	if config.Path != "" && config.Path != "-" {
+		file, err := openRotatingFile(config.Path, int64(config.MaxSizeMB)<<20, config.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		out = file
+	}
+
+	l := &AccessLogger{
+		format:  config.Format,
+		out:     out,
+		entries: make(chan *accessEntry, config.Buffer),
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *AccessLogger) Log(e *accessEntry) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.entries <- e:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// Close writes out everything still queued.
+func (l *AccessLogger) Close() error {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.entries)
+	}
+	l.mu.Unlock()
+	<-l.done
+	if n := l.dropped.Load(); n > 0 {
+		fmt.Printf("Access log: dropped %d entries because the queue was full\n", n)
+	}
+	return l.out.Close()
+}
+
+func (l *AccessLogger) run() {
+	defer close(l.done)
+	w := bufio.NewWriter(l.out)
+	for e := range l.entries {
+		w.Write(l.formatEntry(e))
+		// Flush once the queue is drained so lines show up promptly without a
+		// write syscall per request under load.
+		if len(l.entries) == 0 {
+			w.Flush()
+		}
+	}
+	w.Flush()
+}
+
+func (l *AccessLogger) formatEntry(e *accessEntry) []byte {
+	if l.format == "json" {
+		line, _ := json.Marshal(map[string]any{
+			"time":                e.Time.Format(time.RFC3339Nano),
+			"request_id":          e.RequestID,
+			"client_ip":           e.ClientIP,
+			"method":              e.Method,
+			"host":                e.Host,
+			"path":                e.Path,
+			"proto":               e.Proto,
+			"pool":                e.Pool,
+			"backend":             e.Backend,
+			"status":              e.Status,
+			"bytes_in":            e.BytesIn,
+			"bytes_out":           e.BytesOut,
+			"upstream_latency_ms": float64(e.Upstream.Microseconds()) / 1000,
+			"total_latency_ms":    float64(e.Total.Microseconds()) / 1000,
+			"referer":             e.Referer,
+			"user_agent":          e.UserAgent,
+		})
+		return append(line, '\n')
+	}
+
+	size := "-"
+	if e.BytesOut > 0 {
+		size = strconv.FormatInt(e.BytesOut, 10)
+	}
+	line := fmt.Sprintf("%s - - [%s] %q %d %s", e.ClientIP, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method+" "+e.Path+" "+e.Proto, e.Status, size)
+	if l.format == "combined" {
+		line += fmt.Sprintf(" %q %q", orDash(e.Referer), orDash(e.UserAgent))
+	}
+	return []byte(line + "\n")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// requestID reuses the client's X-Request-Id or makes one up, and makes sure
+// the backend and the client both see it.
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get("X-Request-Id")
+	if id == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+		r.Header.Set("X-Request-Id", id)
+	}
+	w.Header().Set("X-Request-Id", id)
+	return id
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// rotatingFile renames path to path.1 (path.1 to path.2, and so on) once it
+// grows past maxSize. A maxSize of zero never rotates.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups, file: file, size: info.Size()}, nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize && f.size > 0 {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.maxBackups > 0 {
+		for i := f.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		os.Rename(f.path, f.path+".1")
+	} else {
+		os.Remove(f.path)
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	f.file, f.size = file, 0
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// AdminServer is the runtime management API. It listens separately from the
+// balancer's own ports and must not be exposed publicly.
+//
+//	GET    /metrics                                 Prometheus metrics
+//	GET    /pools                                   all pools and their servers
+//	GET    /pools/{pool}                            one pool
+//	POST   /pools/{pool}/servers                    add {"address", "weight", "tags"}
+//	DELETE /pools/{pool}/servers?address=URL        remove
+//	PUT    /pools/{pool}/servers/weight?address=URL set {"weight"}
+//	POST   /pools/{pool}/servers/drain?address=URL[&timeout=30s]
+//	                                                stop sending new requests
+//	POST   /pools/{pool}/servers/undrain?address=URL
+//	GET    /routes                                  all routes and their splits
+//	PUT    /routes/{route}/split                    set {"split": [{"pool", "weight"}]}
+type AdminServer struct {
+	reloader *Reloader
+	pools    map[string]*LoadBalancer
+}
+
+func NewAdminServer(reloader *Reloader, pools map[string]*LoadBalancer) *AdminServer {
+	return &AdminServer{reloader: reloader, pools: pools}
+}
+
+func (a *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", metricsHandler(a.pools))
+	mux.HandleFunc("GET /pools", a.listPools)
+	mux.HandleFunc("GET /pools/{pool}", a.getPool)
+	mux.HandleFunc("POST /pools/{pool}/servers", a.addServer)
+	mux.HandleFunc("DELETE /pools/{pool}/servers", a.removeServer)
+	mux.HandleFunc("PUT /pools/{pool}/servers/weight", a.setWeight)
+	mux.HandleFunc("POST /pools/{pool}/servers/drain", a.drain(true))
+	mux.HandleFunc("POST /pools/{pool}/servers/undrain", a.drain(false))
+	mux.HandleFunc("GET /routes", a.listRoutes)
+	mux.HandleFunc("PUT /routes/{route}/split", a.setSplit)
+	return mux
+}
+
+type poolStatus struct {
+	Name    string         `json:"name"`
+	Servers []serverStatus `json:"servers"`
+}
+
+type serverStatus struct {
+	Address   string   `json:"address"`
+	Weight    int      `json:"weight"`
+	Tags      []string `json:"tags,omitempty"`
+	Healthy   bool     `json:"healthy"`
+	Ejected   bool     `json:"ejected"`
+	Drain     string   `json:"drain"`
+	Breaker   string   `json:"breaker,omitempty"`
+	Available bool     `json:"available"`
+	InFlight  int64    `json:"in_flight"`
+	Requests  uint64   `json:"requests"`
+	LatencyMs float64  `json:"latency_ms"`
+}
+
+func newServerStatus(server Server) serverStatus {
+	status := serverStatus{
+		Address:   server.Address(),
+		Weight:    server.Weight(),
+		Healthy:   server.IsAlive(),
+		Drain:     DrainActive,
+		Available: isAvailable(server),
+		InFlight:  server.InFlight(),
+		LatencyMs: float64(server.Latency().Microseconds()) / 1000,
+	}
+	if server.Draining() {
+		status.Drain = DrainDraining
+	}
+	if s, ok := server.(*SimpleServer); ok {
+		status.Tags = s.Tags()
+		status.Healthy = s.alive.Load()
+		status.Ejected = s.isEjected()
+		status.Requests = s.Requests()
+		status.Drain = s.DrainState()
+		status.Breaker = s.BreakerState()
+	}
+	return status
+}
+
+func (a *AdminServer) poolStatus(name string) poolStatus {
+	status := poolStatus{Name: name, Servers: []serverStatus{}}
+	for _, server := range a.pools[name].Servers() {
+		status.Servers = append(status.Servers, newServerStatus(server))
+	}
+	return status
+}
+
+func (a *AdminServer) listPools(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(a.pools))
+	for name := range a.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pools := make([]poolStatus, 0, len(names))
+	for _, name := range names {
+		pools = append(pools, a.poolStatus(name))
+	}
+	writeJSON(w, http.StatusOK, pools)
+}
+
+func (a *AdminServer) getPool(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("pool")
+	if _, ok := a.pools[name]; !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown pool %q", name))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.poolStatus(name))
+}
+
+func (a *AdminServer) addServer(w http.ResponseWriter, r *http.Request) {
+	var server ServerConfig
+	if err := json.NewDecoder(r.Body).Decode(&server); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.update(w, r, func(pool *PoolConfig) error {
+		if findServer(pool, server.Address) >= 0 {
+			return &adminError{http.StatusConflict, fmt.Errorf("server %q already exists", server.Address)}
+		}
+		pool.Servers = append(pool.Servers, server)
+		return nil
+	}, http.StatusCreated)
+}
+
+func (a *AdminServer) removeServer(w http.ResponseWriter, r *http.Request) {
+	address := r.URL.Query().Get("address")
+	a.update(w, r, func(pool *PoolConfig) error {
+		i := findServer(pool, address)
+		if i < 0 {
+			return errServerNotFound(address)
+		}
+		pool.Servers = slices.Delete(pool.Servers, i, i+1)
+		return nil
+	}, http.StatusOK)
+}
+
+func (a *AdminServer) setWeight(w http.ResponseWriter, r *http.Request) {
+	address := r.URL.Query().Get("address")
+	var body struct {
+		Weight *int `json:"weight"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Weight == nil {
+		writeError(w, http.StatusBadRequest, errors.New(`expected {"weight": N}`))
+		return
+	}
+	a.update(w, r, func(pool *PoolConfig) error {
+		i := findServer(pool, address)
+		if i < 0 {
+			return errServerNotFound(address)
+		}
+		pool.Servers[i].Weight = body.Weight
+		return nil
+	}, http.StatusOK)
+}
+
+// drain is runtime state only; it is not written to the config file. The
+// response's "drain" field turns to "drained" once the last in-flight
+// request is done, so deploy scripts can poll GET /pools/{pool} for it.
+func (a *AdminServer) drain(draining bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, address := r.PathValue("pool"), r.URL.Query().Get("address")
+		lb, ok := a.pools[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown pool %q", name))
+			return
+		}
+		timeout := a.drainTimeout(name)
+		if value := r.URL.Query().Get("timeout"); value != "" {
+			var err error
+			if timeout, err = time.ParseDuration(value); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout %q", value))
+				return
+			}
+		}
+
+		for _, server := range lb.Servers() {
+			if s, ok := server.(*SimpleServer); ok && s.Address() == address {
+				if draining {
+					s.Drain(timeout)
+				} else {
+					s.Undrain()
+				}
+				writeJSON(w, http.StatusOK, newServerStatus(s))
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, errServerNotFound(address))
+	}
+}
+
+func (a *AdminServer) drainTimeout(pool string) time.Duration {
+	for _, p := range a.reloader.Config().Pools {
+		if p.Name == pool {
+			return p.DrainTimeout
+		}
+	}
+	return 0
+}
+
+func (a *AdminServer) update(w http.ResponseWriter, r *http.Request, update func(*PoolConfig) error, status int) {
+	name := r.PathValue("pool")
+	if _, ok := a.pools[name]; !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown pool %q", name))
+		return
+	}
+	if err := a.reloader.UpdatePool(name, update); err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	writeJSON(w, status, a.poolStatus(name))
+}
+
+type routeStatus struct {
+	Name     string        `json:"name"`
+	Listener string        `json:"listener"`
+	Priority int           `json:"priority"`
+	Pool     string        `json:"pool,omitempty"`
+	Split    []SplitConfig `json:"split,omitempty"`
+}
+
+func (a *AdminServer) routes() []routeStatus {
+	routes := []routeStatus{}
+	for _, listener := range a.reloader.Config().Listeners {
+		for _, route := range listener.Routes {
+			routes = append(routes, routeStatus{
+				Name:     route.Name,
+				Listener: listener.Address,
+				Priority: route.Priority,
+				Pool:     route.Pool,
+				Split:    route.Split,
+			})
+		}
+	}
+	return routes
+}
+
+func (a *AdminServer) listRoutes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.routes())
+}
+
+// setSplit changes the route's traffic split at once. Only routes that
+// were split in the config to begin with can be changed.
+func (a *AdminServer) setSplit(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("route")
+	var body struct {
+		Split []SplitConfig `json:"split"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Split) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New(`expected {"split": [{"pool": NAME, "weight": N}, ...]}`))
+		return
+	}
+	i := slices.IndexFunc(a.routes(), func(rs routeStatus) bool { return rs.Name == name })
+	if name == "" || i < 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown route %q", name))
+		return
+	}
+	err := a.reloader.UpdateRoute(name, func(route *RouteConfig) error {
+		if len(route.Split) == 0 {
+			return &adminError{http.StatusConflict, fmt.Errorf("route %q sends everything to pool %q and has no split", name, route.Pool)}
+		}
+		route.Split = body.Split
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.routes()[i])
+}
+
+type adminError struct {
+	status int
+	err    error
+}
+
+func (e *adminError) Error() string {
+	return e.err.Error()
+}
+
+// writeUpdateError answers a config change that failed: with the status an
+// adminError carries, 500 for a change that was applied but not saved, so
+// it isn't retried, or 400 for a change that didn't validate.
+func writeUpdateError(w http.ResponseWriter, err error) {
+	var adminErr *adminError
+	if errors.As(err, &adminErr) {
+		writeError(w, adminErr.status, adminErr.err)
+		return
+	}
+	var persistErr *PersistError
+	if errors.As(err, &persistErr) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeError(w, http.StatusBadRequest, err)
+}
+
+func errServerNotFound(address string) error {
+	return &adminError{http.StatusNotFound, fmt.Errorf("unknown server %q", address)}
+}
+
+func findServer(pool *PoolConfig, address string) int {
+	return slices.IndexFunc(pool.Servers, func(s ServerConfig) bool { return s.Address == address })
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
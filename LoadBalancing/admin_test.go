@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminUnsavedChangeIsNotReportedAsRejected(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+listeners:
+  - address: ":8000"
+    pool: p
+pools:
+  - name: p
+    servers:
+      - address: http://a
+admin:
+  address: ":9000"
+  persist: true
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.path = filepath.Join(t.TempDir(), "missing", "lb.yaml")
+	pools, err := config.BuildPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := NewAdminServer(NewReloader(config, pools, nil, nil), pools)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/pools/p/servers/weight?address=http://a", strings.NewReader(`{"weight": 4}`))
+	admin.Handler().ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "applied, but saving") {
+		t.Errorf("got %d %s, want 500 saying the change was applied", w.Code, w.Body)
+	}
+	if got := pools["p"].Servers()[0].Weight(); got != 4 {
+		t.Errorf("weight = %d, want the change to be live", got)
+	}
+}
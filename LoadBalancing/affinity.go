@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AffinityConfig pins a client to the backend it was first sent to. In
+// cookie mode the balancer sets a signed cookie; in header mode it returns
+// the signed token in a response header and expects clients to echo it.
+type AffinityConfig struct {
+	Mode   string        `json:"mode"`
+	Name   string        `json:"name"`
+	Secret string        `json:"secret"`
+	TTL    time.Duration `json:"ttl"`
+}
+
+type Affinity struct {
+	config AffinityConfig
+}
+
+func NewAffinity(config AffinityConfig) (*Affinity, error) {
+	switch config.Mode {
+	case "cookie":
+		if config.Name == "" {
+			config.Name = "lb_affinity"
+		}
+	case "header":
+		if config.Name == "" {
+			config.Name = "X-LB-Affinity"
+		}
+	default:
+		return nil, fmt.Errorf("unknown affinity mode %q", config.Mode)
+	}
+	if config.Secret == "" {
+		return nil, errors.New("affinity requires a signing secret")
+	}
+	return &Affinity{config: config}, nil
+}
+
+// lookup returns the pinned backend, or nil when the request carries no valid
+// token or that backend can't take traffic right now.
+func (a *Affinity) lookup(r *http.Request, servers []Server) Server {
+	address, ok := a.verify(a.token(r))
+	if !ok {
+		return nil
+	}
+	for _, server := range servers {
+		if server.Address() == address && isAvailable(server) {
+			return server
+		}
+	}
+	return nil
+}
+
+func (a *Affinity) bind(w http.ResponseWriter, server Server) {
+	token := a.sign(server.Address())
+	if a.config.Mode == "header" {
+		w.Header().Set(a.config.Name, token)
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     a.config.Name,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if a.config.TTL > 0 {
+		cookie.MaxAge = int(a.config.TTL.Seconds())
+	}
+	http.SetCookie(w, cookie)
+}
+
+func (a *Affinity) token(r *http.Request) string {
+	if a.config.Mode == "header" {
+		return r.Header.Get(a.config.Name)
+	}
+	cookie, err := r.Cookie(a.config.Name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+func (a *Affinity) sign(address string) string {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(address))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(a.mac(encoded))
+}
+
+func (a *Affinity) verify(token string) (string, bool) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", false
+	}
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, a.mac(encoded)) {
+		return "", false
+	}
+	address, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return string(address), true
+}
+
+func (a *Affinity) mac(data string) []byte {
+	m := hmac.New(sha256.New, []byte(a.config.Secret))
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+var breakerStates = []string{BreakerClosed, BreakerOpen, BreakerHalfOpen}
+
+// BreakerConfig controls the per-backend circuit breaker. It opens after
+// ConsecutiveFailures failures in a row, or when more than ErrorRate percent
+// of the requests in the last Window failed. After OpenDuration it lets
+// HalfOpenProbes requests through and closes again once they all succeed.
+// MaxConcurrent caps the requests a backend gets at a time; zero means no
+// cap.
+type BreakerConfig struct {
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	ErrorRate           float64       `json:"error_rate"`
+	Window              time.Duration `json:"window"`
+	MinRequests         int           `json:"min_requests"`
+	MaxConcurrent       int           `json:"max_concurrent"`
+	OpenDuration        time.Duration `json:"open_duration"`
+	HalfOpenProbes      int           `json:"half_open_probes"`
+}
+
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		ConsecutiveFailures: 5,
+		ErrorRate:           50,
+		Window:              10 * time.Second,
+		MinRequests:         20,
+		OpenDuration:        30 * time.Second,
+		HalfOpenProbes:      3,
+	}
+}
+
+func (c BreakerConfig) withDefaults() BreakerConfig {
+	d := DefaultBreakerConfig()
+	if c.ConsecutiveFailures == 0 {
+		c.ConsecutiveFailures = d.ConsecutiveFailures
+	}
+	if c.ErrorRate == 0 {
+		c.ErrorRate = d.ErrorRate
+	}
+	if c.Window <= 0 {
+		c.Window = d.Window
+	}
+	if c.MinRequests == 0 {
+		c.MinRequests = d.MinRequests
+	}
+	if c.OpenDuration <= 0 {
+		c.OpenDuration = d.OpenDuration
+	}
+	if c.HalfOpenProbes == 0 {
+		c.HalfOpenProbes = d.HalfOpenProbes
+	}
+	return c
+}
+
+const breakerBuckets = 10
+
+type circuitBreaker struct {
+	config BreakerConfig
+	pool   string
+	server string
+
+	mu          sync.Mutex
+	state       string
+	openedAt    time.Time
+	consecutive int
+	inflight    int
+	probes      int
+	successes   int
+	buckets     [breakerBuckets]breakerBucket
+}
+
+type breakerBucket struct {
+	slot     int64
+	requests int
+	failures int
+}
+
+func newCircuitBreaker(config BreakerConfig, pool, server string) *circuitBreaker {
+	return &circuitBreaker{config: config.withDefaults(), pool: pool, server: server, state: BreakerClosed}
+}
+
+// SetBreaker puts a circuit breaker in front of the server; nil removes it.
+func (s *SimpleServer) SetBreaker(config *BreakerConfig) {
+	if config == nil {
+		s.breaker.Store(nil)
+		return
+	}
+	s.breaker.Store(newCircuitBreaker(*config, s.pool, s.address))
+}
+
+// BreakerState is BreakerClosed, BreakerOpen or BreakerHalfOpen, or "" when
+// the server has no breaker.
+func (s *SimpleServer) BreakerState() string {
+	b := s.breaker.Load()
+	if b == nil {
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (s *SimpleServer) breakerAllows() bool {
+	b := s.breaker.Load()
+	return b == nil || b.allows(time.Now())
+}
+
+// allows reports whether a request would be admitted, without taking a
+// slot. Strategies use it to skip the backend.
+func (b *circuitBreaker) allows(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return !now.Before(b.openedAt.Add(b.config.OpenDuration))
+	case BreakerHalfOpen:
+		return b.probes < b.config.HalfOpenProbes
+	}
+	return b.config.MaxConcurrent <= 0 || b.inflight < b.config.MaxConcurrent
+}
+
+// acquire admits a request. probe is true when it was let through to test a
+// half-open backend; it has to be passed back to release.
+func (b *circuitBreaker) acquire() (probe, ok bool) {
+	if b == nil {
+		return false, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.state == BreakerOpen && !now.Before(b.openedAt.Add(b.config.OpenDuration)) {
+		b.transition(BreakerHalfOpen)
+	}
+	switch b.state {
+	case BreakerOpen:
+		return false, false
+	case BreakerHalfOpen:
+		if b.probes >= b.config.HalfOpenProbes {
+			return false, false
+		}
+		b.probes++
+		probe = true
+	default:
+		if b.config.MaxConcurrent > 0 && b.inflight >= b.config.MaxConcurrent {
+			return false, false
+		}
+	}
+	b.inflight++
+	return probe, true
+}
+
+func (b *circuitBreaker) release(probe, failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inflight--
+
+	if probe {
+		if b.state != BreakerHalfOpen {
+			return
+		}
+		b.probes--
+		if failed {
+			b.transition(BreakerOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpenProbes {
+			b.transition(BreakerClosed)
+		}
+		return
+	}
+	// Requests admitted before the breaker opened don't count any more.
+	if b.state != BreakerClosed {
+		return
+	}
+
+	bucket := b.bucket(time.Now())
+	bucket.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	bucket.failures++
+	b.consecutive++
+
+	requests, failures := b.windowCounts(time.Now())
+	if b.consecutive >= b.config.ConsecutiveFailures ||
+		(requests >= b.config.MinRequests && float64(failures)*100 >= b.config.ErrorRate*float64(requests)) {
+		b.transition(BreakerOpen)
+	}
+}
+
+// abandon ends a request that was cancelled by the client, a drain timeout
+// or a lost hedge race. It frees the slot without counting either way, since
+// the backend never got to answer.
+func (b *circuitBreaker) abandon(probe bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inflight--
+	if probe && b.state == BreakerHalfOpen {
+		b.probes--
+	}
+}
+
+// transition must be called with b.mu held.
+func (b *circuitBreaker) transition(state string) {
+	if b.state == state {
+		return
+	}
+	fmt.Printf("Circuit breaker: %s is %s (was %s)\n", b.server, state, b.state)
+	breakerTransitions.inc(b.pool, b.server, state)
+	b.state = state
+	b.probes, b.successes, b.consecutive = 0, 0, 0
+	switch state {
+	case BreakerOpen:
+		b.openedAt = time.Now()
+	case BreakerClosed:
+		b.buckets = [breakerBuckets]breakerBucket{}
+	}
+}
+
+// bucket must be called with b.mu held.
+func (b *circuitBreaker) bucket(now time.Time) *breakerBucket {
+	slot := b.slot(now)
+	bucket := &b.buckets[slot%breakerBuckets]
+	if bucket.slot != slot {
+		*bucket = breakerBucket{slot: slot}
+	}
+	return bucket
+}
+
+// windowCounts must be called with b.mu held.
+func (b *circuitBreaker) windowCounts(now time.Time) (requests, failures int) {
+	slot := b.slot(now)
+	for _, bucket := range b.buckets {
+		if bucket.slot > slot-breakerBuckets {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return requests, failures
+}
+
+func (b *circuitBreaker) slot(now time.Time) int64 {
+	width := max(b.config.Window/breakerBuckets, time.Millisecond)
+	return now.UnixNano() / int64(width)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensOnConsecutiveFailures(t *testing.T) {
+	b := newCircuitBreaker(BreakerConfig{ConsecutiveFailures: 3}, "p", "s")
+	for i := range 3 {
+		probe, ok := b.acquire()
+		if !ok {
+			t.Fatalf("request %d rejected while closed", i)
+		}
+		b.release(probe, true)
+	}
+	if b.state != BreakerOpen {
+		t.Fatalf("state = %s after 3 failures, want open", b.state)
+	}
+	if _, ok := b.acquire(); ok {
+		t.Error("open breaker admitted a request")
+	}
+}
+
+func TestBreakerOpensOnErrorRate(t *testing.T) {
+	b := newCircuitBreaker(BreakerConfig{ConsecutiveFailures: 100, ErrorRate: 50, MinRequests: 10}, "p", "s")
+	for i := range 10 {
+		probe, _ := b.acquire()
+		b.release(probe, i%2 == 1)
+	}
+	if b.state != BreakerOpen {
+		t.Errorf("state = %s at a 50%% error rate, want open", b.state)
+	}
+}
+
+func TestBreakerHalfOpenProbes(t *testing.T) {
+	b := newCircuitBreaker(BreakerConfig{ConsecutiveFailures: 1, OpenDuration: time.Millisecond, HalfOpenProbes: 2}, "p", "s")
+	probe, _ := b.acquire()
+	b.release(probe, true)
+	time.Sleep(2 * time.Millisecond)
+
+	first, ok1 := b.acquire()
+	second, ok2 := b.acquire()
+	if !ok1 || !ok2 || !first || !second || b.state != BreakerHalfOpen {
+		t.Fatalf("want two probes admitted in half_open, state %s", b.state)
+	}
+	if _, ok := b.acquire(); ok {
+		t.Error("a third request was admitted with all probes out")
+	}
+	b.release(first, false)
+	b.release(second, false)
+	if b.state != BreakerClosed {
+		t.Errorf("state = %s after successful probes, want closed", b.state)
+	}
+}
+
+func TestBreakerIgnoresCancelledRequests(t *testing.T) {
+	b := newCircuitBreaker(BreakerConfig{ConsecutiveFailures: 2, OpenDuration: time.Millisecond, HalfOpenProbes: 1}, "p", "s")
+	probe, _ := b.acquire()
+	b.release(probe, true)
+	probe, _ = b.acquire()
+	b.abandon(probe)
+	probe, _ = b.acquire()
+	b.release(probe, true)
+	if b.state != BreakerOpen {
+		t.Fatalf("state = %s, a cancelled request reset the failure count", b.state)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	probe, ok := b.acquire()
+	if !ok || !probe {
+		t.Fatal("no probe admitted after the open duration")
+	}
+	b.abandon(probe)
+	if b.state != BreakerHalfOpen {
+		t.Fatalf("state = %s after a cancelled probe, want half_open", b.state)
+	}
+	if probe, ok := b.acquire(); !ok || !probe {
+		t.Error("the cancelled probe's slot was not freed")
+	}
+}
+
+func TestServeDoesNotCountCancelledProbe(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+	server := NewSimpleServer(backend.URL)
+	server.SetBreaker(&BreakerConfig{ConsecutiveFailures: 1, OpenDuration: time.Millisecond, HalfOpenProbes: 1})
+	b := server.breaker.Load()
+	probe, _ := b.acquire()
+	b.release(probe, true)
+	time.Sleep(2 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	server.Serve(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if state := server.BreakerState(); state != BreakerHalfOpen {
+		t.Errorf("state = %s after a cancelled probe, want half_open", state)
+	}
+}
@@ -0,0 +1,674 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the declarative description of a balancer, loaded from YAML or
+// JSON.
+type Config struct {
+	Listeners []ListenerConfig `json:"listeners"`
+	Pools     []PoolConfig     `json:"pools"`
+	Timeouts  TimeoutConfig    `json:"timeouts"`
+	Admin     *AdminConfig     `json:"admin"`
+	AccessLog *AccessLogConfig `json:"access_log"`
+
+	path  string
+	lines map[string]int
+}
+
+type ListenerConfig struct {
+	Address       string        `json:"address"`
+	Pool          string        `json:"pool"`
+	Routes        []RouteConfig `json:"routes"`
+	TLS           *TLSConfig    `json:"tls"`
+	RedirectHTTPS int           `json:"redirect_https"`
+}
+
+type PoolConfig struct {
+	Name            string             `json:"name"`
+	Strategy        string             `json:"strategy"`
+	HashKey         string             `json:"hash_key"`
+	HashReplicas    int                `json:"hash_replicas"`
+	HashBalance     float64            `json:"hash_balance"`
+	MaglevTableSize int                `json:"maglev_table_size"`
+	LatencyDecay    time.Duration      `json:"latency_decay"`
+	Servers         []ServerConfig     `json:"servers"`
+	HealthCheck     *HealthCheckConfig `json:"health_check"`
+	Outlier         *OutlierConfig     `json:"outlier"`
+	Affinity        *AffinityConfig    `json:"affinity"`
+	Retry           *RetryConfig       `json:"retry"`
+	Breaker         *BreakerConfig     `json:"breaker"`
+	Hedge           *HedgeConfig       `json:"hedge"`
+	Mirror          *MirrorConfig      `json:"mirror"`
+	TLS             *UpstreamTLSConfig `json:"tls"`
+	DrainTimeout    time.Duration      `json:"drain_timeout"`
+	RetryAfter      time.Duration      `json:"retry_after"`
+	UnavailableBody string             `json:"unavailable_body"`
+}
+
+type AdminConfig struct {
+	Address string `json:"address"`
+	Persist bool   `json:"persist"`
+}
+
+// ServerConfig is one backend. Weight defaults to 1 when it is left out;
+// an explicit 0 takes the server out of weighted rotation.
+type ServerConfig struct {
+	Address string   `json:"address"`
+	Weight  *int     `json:"weight"`
+	Tags    []string `json:"tags"`
+}
+
+func (sc ServerConfig) weight() int {
+	if sc.Weight == nil {
+		return 1
+	}
+	return *sc.Weight
+}
+
+type TimeoutConfig struct {
+	Read                   time.Duration `json:"read"`
+	ReadHeader             time.Duration `json:"read_header"`
+	Write                  time.Duration `json:"write"`
+	Idle                   time.Duration `json:"idle"`
+	UpstreamConnect        time.Duration `json:"upstream_connect"`
+	UpstreamResponseHeader time.Duration `json:"upstream_response_header"`
+	Shutdown               time.Duration `json:"shutdown"`
+}
+
+// ConfigError points at the place in a config file that is wrong.
+type ConfigError struct {
+	File string
+	Line int
+	Path string
+	Msg  string
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File + ":")
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "%d:", e.Line)
+	}
+	if b.Len() > 0 {
+		b.WriteString(" ")
+	}
+	if e.Path != "" {
+		b.WriteString(e.Path + ": ")
+	}
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+// ConfigErrors collects every validation problem so they can be fixed in one
+// go.
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+var strategyNames = []string{
+	"round_robin",
+	"least_connections",
+	"weighted_round_robin",
+	"consistent_hash",
+	"maglev",
+	"peak_ewma",
+}
+
+// LoadConfig reads and validates a config file. Files ending in .json are
+// parsed as JSON, everything else as YAML.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := ParseConfig(data, filepath.Ext(path) == ".json")
+	if err != nil {
+		return nil, withFile(err, path)
+	}
+	config.path = path
+	return config, nil
+}
+
+func ParseConfig(data []byte, isJSON bool) (*Config, error) {
+	var root *yaml.Node
+	var err error
+	if isJSON {
+		root, err = parseJSONConfig(data)
+	} else {
+		root, err = parseYAMLDocument(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{lines: make(map[string]int)}
+	if err := decodeNode(root, reflect.ValueOf(config).Elem(), "", config.lines); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Save writes the config back to the file it was loaded from, in the same
+// format. Comments in the original file are not preserved.
+func (c *Config) Save() error {
+	if c.path == "" {
+		return errors.New("config was not loaded from a file")
+	}
+	var b strings.Builder
+	root := encodeNode(reflect.ValueOf(*c))
+	if filepath.Ext(c.path) == ".json" {
+		writeJSONNode(&b, root, "")
+		b.WriteString("\n")
+	} else {
+		enc := yaml.NewEncoder(&b)
+		enc.SetIndent(2)
+		if err := enc.Encode(root); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+	}
+
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// clone copies the config deeply enough for one pool's server list to be
+// edited without touching the original.
+func (c *Config) clone() *Config {
+	clone := *c
+	clone.lines = nil
+	clone.Pools = append([]PoolConfig(nil), c.Pools...)
+	for i := range clone.Pools {
+		clone.Pools[i].Servers = append([]ServerConfig(nil), c.Pools[i].Servers...)
+	}
+	clone.Listeners = append([]ListenerConfig(nil), c.Listeners...)
+	for i := range clone.Listeners {
+		clone.Listeners[i].Routes = append([]RouteConfig(nil), c.Listeners[i].Routes...)
+	}
+	return &clone
+}
+
+func withFile(err error, path string) error {
+	switch e := err.(type) {
+	case *ConfigError:
+		e.File = path
+	case ConfigErrors:
+		for _, ce := range e {
+			ce.File = path
+		}
+	}
+	return err
+}
+
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	report := func(path, format string, args ...any) {
+		errs = append(errs, &ConfigError{Line: c.lineOf(path), Path: path, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	pools := make(map[string]bool)
+	if len(c.Pools) == 0 {
+		report("pools", "at least one pool is required")
+	}
+	for i, pool := range c.Pools {
+		path := fmt.Sprintf("pools[%d]", i)
+		if pool.Name == "" {
+			report(path, "name is required")
+		} else if pools[pool.Name] {
+			report(path+".name", "duplicate pool %q", pool.Name)
+		}
+		pools[pool.Name] = true
+		c.validatePool(pool, path, report)
+	}
+	for i, pool := range c.Pools {
+		if m := pool.Mirror; m != nil {
+			path := fmt.Sprintf("pools[%d].mirror", i)
+			if !pools[m.Pool] {
+				report(path+".pool", "unknown pool %q", m.Pool)
+			} else if m.Pool == pool.Name {
+				report(path+".pool", "a pool can't mirror to itself")
+			}
+			if m.Percent < 0 || m.Percent > 100 {
+				report(path+".percent", "must be between 0 and 100")
+			}
+			if m.MaxBodyBytes < 0 || m.MaxConcurrent < 0 {
+				report(path, "limits must not be negative")
+			}
+		}
+	}
+
+	if len(c.Listeners) == 0 {
+		report("listeners", "at least one listener is required")
+	}
+	addresses := make(map[string]bool)
+	routes := make(map[string]bool)
+	for i, listener := range c.Listeners {
+		path := fmt.Sprintf("listeners[%d]", i)
+		if _, _, err := net.SplitHostPort(listener.Address); err != nil {
+			report(path+".address", "invalid listen address %q", listener.Address)
+		} else if addresses[listener.Address] {
+			report(path+".address", "duplicate listener %q", listener.Address)
+		}
+		addresses[listener.Address] = true
+		if listener.RedirectHTTPS != 0 {
+			if listener.RedirectHTTPS < 0 || listener.RedirectHTTPS > 65535 {
+				report(path+".redirect_https", "expected a port number, got %d", listener.RedirectHTTPS)
+			}
+			if listener.TLS != nil {
+				report(path+".redirect_https", "only a plain HTTP listener can redirect to HTTPS")
+			}
+		} else if listener.Pool == "" && len(listener.Routes) == 0 {
+			report(path, "a pool or at least one route is required")
+		} else if listener.Pool != "" && !pools[listener.Pool] {
+			report(path+".pool", "unknown pool %q", listener.Pool)
+		}
+		if t := listener.TLS; t != nil {
+			if len(t.Certificates) == 0 {
+				report(path+".tls.certificates", "at least one certificate is required")
+			}
+			for j, cc := range t.Certificates {
+				if _, err := loadCertificate(cc); err != nil {
+					report(fmt.Sprintf("%s.tls.certificates[%d]", path, j), "%v", err)
+				}
+			}
+			if _, ok := tlsVersions[t.MinVersion]; t.MinVersion != "" && !ok {
+				report(path+".tls.min_version", "expected 1.2 or 1.3, got %q", t.MinVersion)
+			}
+			if _, ok := clientAuthTypes[t.ClientAuth]; t.ClientAuth != "" && !ok {
+				report(path+".tls.client_auth", "expected optional or require, got %q", t.ClientAuth)
+			}
+			if t.ClientAuth != "" && t.ClientCA == "" {
+				report(path+".tls.client_ca", "required to verify client certificates")
+			}
+			if t.ClientCA != "" {
+				if _, err := loadCertPool(t.ClientCA); err != nil {
+					report(path+".tls.client_ca", "%v", err)
+				}
+			}
+		}
+		for j, route := range listener.Routes {
+			routePath := fmt.Sprintf("%s.routes[%d]", path, j)
+			if route.Name != "" && routes[route.Name] {
+				report(routePath+".name", "duplicate route %q", route.Name)
+			}
+			routes[route.Name] = true
+			validateRoute(route, routePath, pools, report)
+		}
+	}
+
+	if c.Admin != nil {
+		if _, _, err := net.SplitHostPort(c.Admin.Address); err != nil {
+			report("admin.address", "invalid listen address %q", c.Admin.Address)
+		} else if addresses[c.Admin.Address] {
+			report("admin.address", "must differ from every listener address")
+		}
+	}
+
+	if l := c.AccessLog; l != nil {
+		if l.Format != "" && !contains(accessLogFormats, l.Format) {
+			report("access_log.format", "unknown format %q, expected one of %s", l.Format, strings.Join(accessLogFormats, ", "))
+		}
+		if l.MaxSizeMB < 0 || l.MaxBackups < 0 || l.Buffer < 0 {
+			report("access_log", "sizes must not be negative")
+		}
+	}
+
+	timeouts := reflect.ValueOf(c.Timeouts)
+	for i := 0; i < timeouts.NumField(); i++ {
+		if timeouts.Field(i).Int() < 0 {
+			report("timeouts."+tagName(timeouts.Type().Field(i)), "must not be negative")
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+	return errs
+}
+
+func validateRoute(route RouteConfig, path string, pools map[string]bool, report func(string, string, ...any)) {
+	switch {
+	case route.Pool != "" && len(route.Split) > 0:
+		report(path, "pool and split are mutually exclusive")
+	case len(route.Split) > 0:
+		if route.Name == "" {
+			report(path+".name", "a split route needs a name")
+		}
+		validateSplit(route.Split, path+".split", pools, report)
+	case !pools[route.Pool]:
+		report(path+".pool", "unknown pool %q", route.Pool)
+	}
+	if route.PathPrefix != "" && !strings.HasPrefix(route.PathPrefix, "/") {
+		report(path+".path_prefix", "must start with /")
+	}
+	if route.PathRegex != "" {
+		if _, err := regexp.Compile(route.PathRegex); err != nil {
+			report(path+".path_regex", "%v", err)
+		}
+	}
+	if strings.Contains(strings.TrimPrefix(route.Host, "*."), "*") {
+		report(path+".host", "only a leading *. wildcard is supported")
+	}
+	for k, method := range route.Methods {
+		if method == "" || strings.ToUpper(method) != method {
+			report(fmt.Sprintf("%s.methods[%d]", path, k), "expected an upper-case HTTP method, got %q", method)
+		}
+	}
+}
+
+func validateSplit(split []SplitConfig, path string, pools map[string]bool, report func(string, string, ...any)) {
+	total := 0
+	seen := make(map[string]bool)
+	for k, variant := range split {
+		variantPath := fmt.Sprintf("%s[%d]", path, k)
+		if !pools[variant.Pool] {
+			report(variantPath+".pool", "unknown pool %q", variant.Pool)
+		} else if seen[variant.Pool] {
+			report(variantPath+".pool", "duplicate pool %q", variant.Pool)
+		}
+		seen[variant.Pool] = true
+		if variant.Weight < 0 {
+			report(variantPath+".weight", "must not be negative")
+		}
+		total += variant.Weight
+	}
+	if total <= 0 {
+		report(path, "weights must add up to more than zero")
+	}
+}
+
+func (c *Config) validatePool(pool PoolConfig, path string, report func(string, string, ...any)) {
+	if pool.Strategy != "" && !contains(strategyNames, pool.Strategy) {
+		report(path+".strategy", "unknown strategy %q, expected one of %s", pool.Strategy, strings.Join(strategyNames, ", "))
+	}
+	if _, err := ParseHashKey(pool.HashKey); err != nil {
+		report(path+".hash_key", "%v", err)
+	}
+	if pool.HashBalance < 0 {
+		report(path+".hash_balance", "must not be negative")
+	}
+
+	if t := pool.TLS; t != nil {
+		if (t.Cert == "") != (t.Key == "") {
+			report(path+".tls", "cert and key must be set together")
+		} else if _, err := t.clientConfig(); err != nil {
+			report(path+".tls", "%v", err)
+		}
+	}
+
+	if len(pool.Servers) == 0 {
+		report(path+".servers", "at least one server is required")
+	}
+	seen := make(map[string]bool)
+	for j, server := range pool.Servers {
+		serverPath := fmt.Sprintf("%s.servers[%d]", path, j)
+		u, err := url.Parse(server.Address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			report(serverPath+".address", "expected an http:// or https:// URL, got %q", server.Address)
+		} else if seen[server.Address] {
+			report(serverPath+".address", "duplicate server %q", server.Address)
+		}
+		seen[server.Address] = true
+		if server.weight() < 0 {
+			report(serverPath+".weight", "must not be negative")
+		}
+	}
+
+	if hc := pool.HealthCheck; hc != nil {
+		if !strings.HasPrefix(hc.Path, "/") && hc.Path != "" {
+			report(path+".health_check.path", "must start with /")
+		}
+		if hc.ExpectedStatusMin > hc.ExpectedStatusMax {
+			report(path+".health_check.expected_status_min", "must not exceed expected_status_max")
+		}
+	}
+	if o := pool.Outlier; o != nil && (o.MaxEjectionPercent < 0 || o.MaxEjectionPercent > 100) {
+		report(path+".outlier.max_ejection_percent", "must be between 0 and 100")
+	}
+	if a := pool.Affinity; a != nil {
+		if _, err := NewAffinity(*a); err != nil {
+			report(path+".affinity", "%v", err)
+		}
+	}
+	if b := pool.Breaker; b != nil {
+		if b.ConsecutiveFailures < 0 || b.MinRequests < 0 || b.MaxConcurrent < 0 || b.HalfOpenProbes < 0 {
+			report(path+".breaker", "counts must not be negative")
+		}
+		if b.ErrorRate < 0 || b.ErrorRate > 100 {
+			report(path+".breaker.error_rate", "must be between 0 and 100")
+		}
+	}
+	if h := pool.Hedge; h != nil {
+		if h.Percentile < 0 || h.Percentile > 100 {
+			report(path+".hedge.percentile", "must be between 0 and 100")
+		}
+		if h.MaxPercent < 0 || h.MaxPercent > 100 {
+			report(path+".hedge.max_percent", "must be between 0 and 100")
+		}
+	}
+	if rc := pool.Retry; rc != nil {
+		if rc.Attempts < 0 || rc.MinRetries < 0 || rc.MaxBodyBytes < 0 {
+			report(path+".retry", "attempts, min_retries and max_body_bytes must not be negative")
+		}
+		if rc.Attempts > maxRetryAttempts {
+			report(path+".retry.attempts", "must be at most %d", maxRetryAttempts)
+		}
+		if rc.BudgetPercent < 0 || rc.BudgetPercent > 100 {
+			report(path+".retry.budget_percent", "must be between 0 and 100")
+		}
+		for k, method := range rc.Methods {
+			if method == "" || strings.ToUpper(method) != method {
+				report(fmt.Sprintf("%s.retry.methods[%d]", path, k), "expected an upper-case HTTP method, got %q", method)
+			}
+		}
+	}
+}
+
+// lineOf finds the line of path, or of its closest parent that has one.
+func (c *Config) lineOf(path string) int {
+	for path != "" {
+		if line, ok := c.lines[path]; ok {
+			return line
+		}
+		if i := strings.LastIndexAny(path, ".["); i >= 0 {
+			path = path[:i]
+		} else {
+			break
+		}
+	}
+	return 0
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultConfig is what the balancer runs without -config.
+func defaultConfig() *Config {
+	return &Config{
+		Listeners: []ListenerConfig{{Address: ":8000", Pool: "default"}},
+		Pools: []PoolConfig{{
+			Name: "default",
+			Servers: []ServerConfig{
+				{Address: "https://daryo.uz"},
+				{Address: "https://kun.uz"},
+				{Address: "https://afisha.uz"},
+			},
+			HealthCheck: &HealthCheckConfig{},
+			Outlier:     &OutlierConfig{},
+		}},
+	}
+}
+
+// BuildPools creates one LoadBalancer per pool, keyed by pool name.
+func (c *Config) BuildPools() (map[string]*LoadBalancer, error) {
+	pools := make(map[string]*LoadBalancer, len(c.Pools))
+	for _, pool := range c.Pools {
+		lb, err := c.buildPool(pool)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", pool.Name, err)
+		}
+		pools[pool.Name] = lb
+	}
+	for _, pool := range c.Pools {
+		if pool.Mirror != nil {
+			pools[pool.Name].SetMirror(NewMirror(*pool.Mirror, pools[pool.Mirror.Pool]))
+		}
+	}
+	return pools, nil
+}
+
+func (c *Config) buildPool(pool PoolConfig) (*LoadBalancer, error) {
+	strategy, err := newStrategy(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	var outliers *OutlierDetector
+	if pool.Outlier != nil {
+		outliers = NewOutlierDetector(pool.Outlier.withDefaults())
+	}
+	servers := make([]Server, 0, len(pool.Servers))
+	for _, sc := range pool.Servers {
+		server, err := c.buildServer(pool, sc)
+		if err != nil {
+			return nil, err
+		}
+		if outliers != nil {
+			outliers.Attach(server)
+		}
+		servers = append(servers, server)
+	}
+
+	lb := NewLoadBalancer(servers)
+	lb.name = pool.Name
+	lb.SetStrategy(strategy)
+	lb.outliers = outliers
+	if pool.Affinity != nil {
+		affinity, err := NewAffinity(*pool.Affinity)
+		if err != nil {
+			return nil, err
+		}
+		lb.SetAffinity(affinity)
+	}
+	if pool.Retry != nil {
+		lb.SetRetry(NewRetryPolicy(*pool.Retry))
+	}
+	if pool.Hedge != nil {
+		lb.SetHedge(NewHedgePolicy(*pool.Hedge))
+	}
+	if pool.RetryAfter > 0 || pool.UnavailableBody != "" {
+		retryAfter, body := lb.retryAfter, lb.unavailableBody
+		if pool.RetryAfter > 0 {
+			retryAfter = pool.RetryAfter
+		}
+		if pool.UnavailableBody != "" {
+			body = pool.UnavailableBody
+		}
+		lb.SetUnavailableResponse(retryAfter, body)
+	}
+	return lb, nil
+}
+
+func (c *Config) buildServer(pool PoolConfig, sc ServerConfig) (*SimpleServer, error) {
+	server := NewSimpleServer(sc.Address)
+	server.pool = pool.Name
+	if err := server.SetUpstreamTLS(pool.TLS); err != nil {
+		return nil, fmt.Errorf("pool %s: %w", pool.Name, err)
+	}
+	server.SetWeight(sc.weight())
+	server.SetTags(sc.Tags)
+	server.SetUpstreamTimeouts(c.Timeouts.UpstreamConnect, c.Timeouts.UpstreamResponseHeader)
+	if pool.LatencyDecay > 0 {
+		server.SetLatencyDecay(pool.LatencyDecay)
+	}
+	if pool.HealthCheck != nil {
+		server.StartHealthCheck(*pool.HealthCheck)
+	}
+	server.SetBreaker(pool.Breaker)
+	return server, nil
+}
+
+func newStrategy(pool PoolConfig) (Strategy, error) {
+	key, err := ParseHashKey(pool.HashKey)
+	if err != nil {
+		return nil, err
+	}
+	switch pool.Strategy {
+	case "", "round_robin":
+		return NewRoundRobinStrategy(), nil
+	case "least_connections":
+		return NewLeastConnectionsStrategy(), nil
+	case "weighted_round_robin":
+		return NewWeightedRoundRobinStrategy(), nil
+	case "consistent_hash":
+		return NewConsistentHashStrategy(key, pool.HashReplicas, pool.HashBalance), nil
+	case "maglev":
+		return NewMaglevStrategy(key, pool.MaglevTableSize), nil
+	case "peak_ewma":
+		return NewPeakEWMAStrategy(), nil
+	}
+	return nil, fmt.Errorf("unknown strategy %q", pool.Strategy)
+}
+
+// certificateFiles lists every certificate and key file the listeners use.
+func (c *Config) certificateFiles() []string {
+	var files []string
+	for _, listener := range c.Listeners {
+		if listener.TLS != nil {
+			for _, cc := range listener.TLS.Certificates {
+				files = append(files, cc.Cert, cc.Key)
+			}
+		}
+	}
+	return files
+}
+
+// NewHTTPServer creates the front-end server for one listener.
+func (c *Config) NewHTTPServer(listener ListenerConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              listener.Address,
+		Handler:           handler,
+		ReadTimeout:       c.Timeouts.Read,
+		ReadHeaderTimeout: c.Timeouts.ReadHeader,
+		WriteTimeout:      c.Timeouts.Write,
+		IdleTimeout:       c.Timeouts.Idle,
+	}
+}
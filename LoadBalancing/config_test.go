@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServerWeightZeroIsKept(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+listeners:
+  - address: ":8000"
+    pool: p
+pools:
+  - name: p
+    servers:
+      - address: http://a
+      - address: http://b
+        weight: 0
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := config.Pools[0].Servers
+	if got := servers[0].weight(); got != 1 {
+		t.Errorf("weight without a value = %d, want 1", got)
+	}
+	if got := servers[1].weight(); got != 0 {
+		t.Errorf("weight: 0 = %d, want 0", got)
+	}
+}
+
+func TestParseConfigAcceptsFlowMappingsAndBlockScalars(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+listeners:
+  - {address: ":8000", pool: p}
+pools:
+  - name: p
+    servers:
+      - {address: http://a, weight: 2}
+    unavailable_body: |
+      down for maintenance
+      back soon
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := config.Pools[0]
+	if pool.Servers[0].Address != "http://a" || pool.Servers[0].weight() != 2 {
+		t.Errorf("server = %+v, want http://a with weight 2", pool.Servers[0])
+	}
+	if want := "down for maintenance\nback soon\n"; pool.UnavailableBody != want {
+		t.Errorf("unavailable_body = %q, want %q", pool.UnavailableBody, want)
+	}
+}
+
+func TestParseConfigErrorsHaveLines(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		want   string
+	}{
+		{"pools:\n  - name: p\n    name: q\n", `3: pools[0].name: duplicate key "name"`},
+		{"pools:\n  - name: p\n    colour: red\n", "3: pools[0].colour: unknown field"},
+		{"pools:\n  - name: p\n    servers: {}\n", "3: pools[0].servers: expected a list, got a mapping"},
+		{"pools:\n  - name: p\n    servers: [\n", "3: "},
+	} {
+		_, err := ParseConfig([]byte(tc.config), false)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("error = %v, want %s", err, tc.want)
+		}
+	}
+}
+
+func TestConfigSaveRoundTrips(t *testing.T) {
+	data, err := os.ReadFile("lb.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := ParseConfig(data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Strings that read as other types unless they are quoted.
+	original.Pools[0].Servers[0].Tags = []string{"2024", "true", "null", ": x"}
+	for _, name := range []string{"lb.yaml", "lb.json"} {
+		config := original.clone()
+		config.path = filepath.Join(t.TempDir(), name)
+		if err := config.Save(); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := LoadConfig(config.path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		saved.path, saved.lines, config.lines = "", nil, nil
+		config.path = ""
+		if !reflect.DeepEqual(saved, config) {
+			t.Errorf("%s: read back %+v, want %+v", name, saved, config)
+		}
+	}
+}
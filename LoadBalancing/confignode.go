@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config files are parsed into yaml.Node trees, which remember the line every
+// value came from, so validation errors can point at the file. JSON files go
+// through encoding/json and are turned into the same kind of tree.
+
+// yamlErrorLine matches the position yaml.v3 puts in its syntax errors.
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+func parseYAMLDocument(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			return nil, &ConfigError{Line: line, Msg: m[2]}
+		}
+		return nil, &ConfigError{Msg: strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode, Line: 1}, nil
+	}
+	return doc.Content[0], nil
+}
+
+func parseJSONConfig(data []byte) (*yaml.Node, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	lineAt := func(offset int64) int {
+		for offset < int64(len(data)) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+			offset++
+		}
+		return 1 + bytes.Count(data[:offset], []byte("\n"))
+	}
+	syntaxError := func(err error) error {
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			return &ConfigError{Line: lineAt(syntax.Offset - 1), Msg: syntax.Error()}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return &ConfigError{Line: lineAt(int64(len(data))), Msg: "unexpected end of JSON input"}
+		}
+		return err
+	}
+
+	var parse func() (*yaml.Node, error)
+	parse = func() (*yaml.Node, error) {
+		line := lineAt(dec.InputOffset())
+		token, err := dec.Token()
+		if err != nil {
+			return nil, syntaxError(err)
+		}
+		switch t := token.(type) {
+		case json.Delim:
+			if t == '{' {
+				node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: line}
+				for dec.More() {
+					keyLine := lineAt(dec.InputOffset())
+					key, err := dec.Token()
+					if err != nil {
+						return nil, syntaxError(err)
+					}
+					value, err := parse()
+					if err != nil {
+						return nil, err
+					}
+					if isNull(value) {
+						value.Line = keyLine
+					}
+					node.Content = append(node.Content, scalar("!!str", key.(string), keyLine), value)
+				}
+				_, err := dec.Token()
+				return node, syntaxError(err)
+			}
+			node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: line}
+			for dec.More() {
+				item, err := parse()
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, item)
+			}
+			_, err := dec.Token()
+			return node, syntaxError(err)
+		case nil:
+			return scalar("!!null", "null", line), nil
+		case string:
+			return scalar("!!str", t, line), nil
+		case bool:
+			return scalar("!!bool", strconv.FormatBool(t), line), nil
+		case json.Number:
+			if _, err := t.Int64(); err == nil {
+				return scalar("!!int", t.String(), line), nil
+			}
+			return scalar("!!float", t.String(), line), nil
+		default:
+			return nil, &ConfigError{Line: line, Msg: fmt.Sprintf("unexpected %v", t)}
+		}
+	}
+
+	root, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, &ConfigError{Line: lineAt(dec.InputOffset()), Msg: "unexpected data after top-level value"}
+	}
+	return root, nil
+}
+
+func scalar(tag, value string, line int) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value, Line: line}
+}
+
+func isNull(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && n.ShortTag() == "!!null"
+}
+
+func kindName(n *yaml.Node) string {
+	switch {
+	case isNull(n):
+		return "null"
+	case n.Kind == yaml.ScalarNode:
+		return "a value"
+	case n.Kind == yaml.MappingNode:
+		return "a mapping"
+	case n.Kind == yaml.SequenceNode:
+		return "a list"
+	}
+	return "an unsupported node"
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// decodeNode fills v from n using the fields' json tags. It records the line
+// of every path it visits so later validation can report positions too.
+func decodeNode(n *yaml.Node, v reflect.Value, path string, lines map[string]int) error {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	lines[path] = n.Line
+	if isNull(n) {
+		return nil
+	}
+	fail := func(format string, args ...any) error {
+		return &ConfigError{Line: n.Line, Path: path, Msg: fmt.Sprintf(format, args...)}
+	}
+	expect := func(kind yaml.Kind, name string) error {
+		if n.Kind != kind {
+			return fail("expected %s, got %s", name, kindName(n))
+		}
+		return nil
+	}
+	expectScalar := func() error { return expect(yaml.ScalarNode, "a value") }
+
+	if v.Type() == durationType {
+		if err := expectScalar(); err != nil {
+			return err
+		}
+		d, err := time.ParseDuration(n.Value)
+		if err != nil {
+			return fail("invalid duration %q", n.Value)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		if err := expectScalar(); err != nil {
+			return err
+		}
+		v.SetString(n.Value)
+	case reflect.Int, reflect.Int64:
+		if err := expectScalar(); err != nil {
+			return err
+		}
+		i, err := strconv.ParseInt(n.Value, 10, 64)
+		if err != nil {
+			return fail("invalid integer %q", n.Value)
+		}
+		v.SetInt(i)
+	case reflect.Float64:
+		if err := expectScalar(); err != nil {
+			return err
+		}
+		f, err := strconv.ParseFloat(n.Value, 64)
+		if err != nil {
+			return fail("invalid number %q", n.Value)
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		if err := expectScalar(); err != nil {
+			return err
+		}
+		b, err := strconv.ParseBool(n.Value)
+		if err != nil {
+			return fail("invalid boolean %q", n.Value)
+		}
+		v.SetBool(b)
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeNode(n, v.Elem(), path, lines)
+	case reflect.Slice:
+		if err := expect(yaml.SequenceNode, "a list"); err != nil {
+			return err
+		}
+		slice := reflect.MakeSlice(v.Type(), len(n.Content), len(n.Content))
+		for i, item := range n.Content {
+			if err := decodeNode(item, slice.Index(i), fmt.Sprintf("%s[%d]", path, i), lines); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Map:
+		if err := expect(yaml.MappingNode, "a mapping"); err != nil {
+			return err
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(n.Content)/2)
+		err := eachEntry(n, path, func(key string, value *yaml.Node) error {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeNode(value, elem, joinPath(path, key), lines); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(key), elem)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		v.Set(m)
+	case reflect.Struct:
+		if err := expect(yaml.MappingNode, "a mapping"); err != nil {
+			return err
+		}
+		return eachEntry(n, path, func(key string, value *yaml.Node) error {
+			field, ok := fieldByTag(v, key)
+			if !ok {
+				return &ConfigError{Line: value.Line, Path: joinPath(path, key), Msg: "unknown field"}
+			}
+			return decodeNode(value, field, joinPath(path, key), lines)
+		})
+	default:
+		return fail("unsupported field type %s", v.Type())
+	}
+	return nil
+}
+
+// eachEntry calls fn for the key/value pairs of mapping n in order. Keys
+// must be plain values and may appear only once.
+func eachEntry(n *yaml.Node, path string, fn func(key string, value *yaml.Node) error) error {
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if key.Kind != yaml.ScalarNode {
+			return &ConfigError{Line: key.Line, Path: path, Msg: "mapping keys must be plain values"}
+		}
+		if seen[key.Value] {
+			return &ConfigError{Line: key.Line, Path: joinPath(path, key.Value), Msg: fmt.Sprintf("duplicate key %q", key.Value)}
+		}
+		seen[key.Value] = true
+		if err := fn(key.Value, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fieldByTag(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if tagName(t.Field(i)) == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func tagName(f reflect.StructField) string {
+	if !f.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// encodeNode is the inverse of decodeNode. Zero values are left out so
+// written files only contain what was set.
+func encodeNode(v reflect.Value) *yaml.Node {
+	if v.IsZero() {
+		return nil
+	}
+	return encodeValue(v)
+}
+
+// encodeValue encodes v even if it is the zero value. A pointer says the
+// field was set: an empty section still means something, e.g. enabling
+// health checks with the defaults, and so does a weight of 0.
+func encodeValue(v reflect.Value) *yaml.Node {
+	if v.Type() == durationType {
+		return scalar("!!str", time.Duration(v.Int()).String(), 0)
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return scalar("!!str", v.String(), 0)
+	case reflect.Int, reflect.Int64:
+		return scalar("", strconv.FormatInt(v.Int(), 10), 0)
+	case reflect.Float64:
+		// Untagged, so 20 is written as 20 rather than as a tagged float.
+		return scalar("", strconv.FormatFloat(v.Float(), 'g', -1, 64), 0)
+	case reflect.Bool:
+		return scalar("", strconv.FormatBool(v.Bool()), 0)
+	case reflect.Pointer:
+		return encodeValue(v.Elem())
+	case reflect.Slice:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Style: yaml.FlowStyle}
+		for i := 0; i < v.Len(); i++ {
+			item := encodeNode(v.Index(i))
+			if item == nil {
+				item = scalar("!!null", "null", 0)
+			}
+			if item.Kind != yaml.ScalarNode {
+				node.Style = 0
+			}
+			node.Content = append(node.Content, item)
+		}
+		return node
+	case reflect.Map:
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			if value := encodeNode(v.MapIndex(key)); value != nil {
+				node.Content = append(node.Content, scalar("!!str", key.String(), 0), value)
+			}
+		}
+		return node
+	case reflect.Struct:
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for i := 0; i < v.NumField(); i++ {
+			name := tagName(v.Type().Field(i))
+			if name == "" {
+				continue
+			}
+			if value := encodeNode(v.Field(i)); value != nil {
+				node.Content = append(node.Content, scalar("!!str", name, 0), value)
+			}
+		}
+		return node
+	}
+	return nil
+}
+
+func writeJSONNode(b *strings.Builder, n *yaml.Node, indent string) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if n.Tag == "!!str" {
+			quoted, _ := json.Marshal(n.Value)
+			b.Write(quoted)
+		} else {
+			b.WriteString(n.Value)
+		}
+	case yaml.SequenceNode:
+		if len(n.Content) == 0 {
+			b.WriteString("[]")
+			return
+		}
+		b.WriteString("[\n")
+		for i, item := range n.Content {
+			b.WriteString(indent + "  ")
+			writeJSONNode(b, item, indent+"  ")
+			if i < len(n.Content)-1 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString(indent + "]")
+	case yaml.MappingNode:
+		if len(n.Content) == 0 {
+			b.WriteString("{}")
+			return
+		}
+		b.WriteString("{\n")
+		for i := 0; i < len(n.Content); i += 2 {
+			quoted, _ := json.Marshal(n.Content[i].Value)
+			b.WriteString(indent + "  ")
+			b.Write(quoted)
+			b.WriteString(": ")
+			writeJSONNode(b, n.Content[i+1], indent+"  ")
+			if i < len(n.Content)-2 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString(indent + "}")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	DrainActive   = "active"
+	DrainDraining = "draining"
+	DrainDrained  = "drained"
+)
+
+// lifetime is cancelled when a drain times out, which aborts every request
+// still being proxied to the server.
+type lifetime struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newLifetime() *lifetime {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifetime{ctx: ctx, cancel: cancel}
+}
+
+func (s *SimpleServer) Draining() bool {
+	return s.draining.Load()
+}
+
+// Drain stops sending new requests to the server and lets in-flight ones
+// finish. Once timeout passes, whatever is still running is cancelled. A
+// zero timeout waits forever.
+func (s *SimpleServer) Drain(timeout time.Duration) {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	if s.draining.Load() {
+		return
+	}
+	s.draining.Store(true)
+	if timeout > 0 {
+		life := s.lifetime.Load()
+		s.drainTimer = time.AfterFunc(timeout, func() {
+			if n := s.InFlight(); n > 0 {
+				fmt.Printf("Drain: timeout for %s, cancelling %d requests\n", s.address, n)
+			}
+			life.cancel()
+		})
+	}
+}
+
+func (s *SimpleServer) Undrain() {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	if s.drainTimer != nil {
+		s.drainTimer.Stop()
+		s.drainTimer = nil
+	}
+	if s.lifetime.Load().ctx.Err() != nil {
+		s.lifetime.Store(newLifetime())
+	}
+	s.draining.Store(false)
+}
+
+// DrainState is DrainActive, DrainDraining or DrainDrained.
+func (s *SimpleServer) DrainState() string {
+	switch {
+	case !s.Draining():
+		return DrainActive
+	case s.InFlight() > 0:
+		return DrainDraining
+	}
+	return DrainDrained
+}
+
+// withLifetime ties the proxied request to the server's lifetime so a drain
+// timeout can cut it off.
+func (s *SimpleServer) withLifetime(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(s.lifetime.Load().ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// whenDrained runs f once the server has no requests left.
+func (s *SimpleServer) whenDrained(f func()) {
+	go func() {
+		for s.InFlight() > 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		f()
+	}()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// HashKeyFunc extracts the routing key that hashing strategies map to a
+// backend.
+type HashKeyFunc func(*http.Request) string
+
+// ParseHashKey understands "path", "ip", "header:<Name>" and "cookie:<name>".
+// Requests missing the header or cookie fall back to the client IP.
+func ParseHashKey(spec string) (HashKeyFunc, error) {
+	kind, name, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "ip":
+		return clientIP, nil
+	case "path":
+		return func(r *http.Request) string { return r.URL.Path }, nil
+	case "header":
+		if name == "" {
+			return nil, fmt.Errorf("hash key %q: missing header name", spec)
+		}
+		return func(r *http.Request) string {
+			if value := r.Header.Get(name); value != "" {
+				return value
+			}
+			return clientIP(r)
+		}, nil
+	case "cookie":
+		if name == "" {
+			return nil, fmt.Errorf("hash key %q: missing cookie name", spec)
+		}
+		return func(r *http.Request) string {
+			if cookie, err := r.Cookie(name); err == nil && cookie.Value != "" {
+				return cookie.Value
+			}
+			return clientIP(r)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown hash key %q", spec)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return mix64(h.Sum64())
+}
+
+// mix64 is the splitmix64 finalizer; FNV alone clusters similar keys.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// serverSet identifies a server slice by its backing array. SetServers
+// always stores a fresh slice, so hashing strategies can tell that the set
+// changed without looking at every server.
+type serverSet struct {
+	first *Server
+	n     int
+}
+
+func serverSetOf(servers []Server) serverSet {
+	if len(servers) == 0 {
+		return serverSet{}
+	}
+	return serverSet{&servers[0], len(servers)}
+}
+
+// weightChanges counts weight changes on any server, so strategies that
+// depend on weights know to rebuild.
+var weightChanges atomic.Uint64
+
+// fingerprint identifies a server set by its addresses in order. Weights are
+// left out; Maglev doesn't use them.
+func fingerprint(servers []Server) uint64 {
+	h := fnv.New64a()
+	for _, server := range servers {
+		h.Write([]byte(server.Address()))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// ConsistentHashStrategy places every server on a hash ring many times
+// (virtual nodes) and sends a key to the first server clockwise from it.
+// Adding or removing a server only moves the keys next to its nodes, about
+// 1/N of the total. With bounded loads a server is skipped while it holds
+// more than (1+balance) times the average number of in-flight requests.
+type ConsistentHashStrategy struct {
+	key      HashKeyFunc
+	replicas int
+	balance  float64
+
+	mu   sync.RWMutex
+	ring *hashRing
+}
+
+type hashRing struct {
+	set     serverSet
+	weights uint64
+	servers []Server
+	hashes  []uint64
+	owners  []Server
+}
+
+// NewConsistentHashStrategy builds a ring with replicas virtual nodes per unit
+// of weight. A balance of zero disables bounded loads.
+func NewConsistentHashStrategy(key HashKeyFunc, replicas int, balance float64) *ConsistentHashStrategy {
+	if replicas <= 0 {
+		replicas = 100
+	}
+	return &ConsistentHashStrategy{key: key, replicas: replicas, balance: balance}
+}
+
+func (ch *ConsistentHashStrategy) Select(servers []Server, r *http.Request) Server {
+	ring := ch.ringFor(servers)
+	if len(ring.hashes) == 0 {
+		return nil
+	}
+
+	capacity := int64(math.MaxInt64)
+	if ch.balance > 0 {
+		capacity = boundedCapacity(servers, ch.balance)
+	}
+
+	h := hashString(ch.key(r))
+	start := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= h })
+	var fallback Server
+	for i := range ring.hashes {
+		server := ring.owners[(start+i)%len(ring.hashes)]
+		if !isAvailable(server) {
+			continue
+		}
+		if server.InFlight() < capacity {
+			return server
+		}
+		if fallback == nil {
+			fallback = server
+		}
+	}
+	return fallback
+}
+
+// boundedCapacity is ceil((1+balance) * average load), counting the request
+// being placed.
+func boundedCapacity(servers []Server, balance float64) int64 {
+	var total, available int64
+	for _, server := range servers {
+		if isAvailable(server) {
+			total += server.InFlight()
+			available++
+		}
+	}
+	if available == 0 {
+		return 0
+	}
+	return int64(math.Ceil(float64(total+1) * (1 + balance) / float64(available)))
+}
+
+func (ch *ConsistentHashStrategy) ringFor(servers []Server) *hashRing {
+	set, weights := serverSetOf(servers), weightChanges.Load()
+	ch.mu.RLock()
+	ring := ch.ring
+	ch.mu.RUnlock()
+	if ring != nil && ring.set == set && ring.weights == weights {
+		return ring
+	}
+
+	ring = buildHashRing(servers, ch.replicas)
+	ring.set, ring.weights = set, weights
+	ch.mu.Lock()
+	ch.ring = ring
+	ch.mu.Unlock()
+	return ring
+}
+
+func buildHashRing(servers []Server, replicas int) *hashRing {
+	type node struct {
+		hash  uint64
+		owner Server
+	}
+	var nodes []node
+	for _, server := range servers {
+		count := replicas * server.Weight()
+		for i := 0; i < count; i++ {
+			nodes = append(nodes, node{hashString(server.Address() + "#" + strconv.Itoa(i)), server})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].hash < nodes[j].hash })
+
+	// The ring keeps servers so its backing array, which identifies the
+	// set, can't be reused by another slice.
+	ring := &hashRing{
+		servers: servers,
+		hashes:  make([]uint64, len(nodes)),
+		owners:  make([]Server, len(nodes)),
+	}
+	for i, n := range nodes {
+		ring.hashes[i], ring.owners[i] = n.hash, n.owner
+	}
+	return ring
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func pathRequest(path string) *http.Request {
+	return httptest.NewRequest(http.MethodGet, path, nil)
+}
+
+func manyFakeServers(n int) []Server {
+	servers := make([]Server, n)
+	for i := range servers {
+		servers[i] = &fakeServer{address: fmt.Sprintf("http://10.0.%d.%d", i/256, i%256), weight: 1}
+	}
+	return servers
+}
+
+func TestConsistentHashMovesFewKeys(t *testing.T) {
+	key, _ := ParseHashKey("path")
+	servers := manyFakeServers(10)
+	before := NewConsistentHashStrategy(key, 0, 0)
+	after := NewConsistentHashStrategy(key, 0, 0)
+	remaining := servers[:9]
+
+	moved := 0
+	const keys = 2000
+	for i := range keys {
+		r := pathRequest(fmt.Sprintf("/item/%d", i))
+		was := before.Select(servers, r)
+		if before.Select(servers, r) != was {
+			t.Fatal("the same key went to different servers")
+		}
+		if was != servers[9] && after.Select(remaining, r) != was {
+			moved++
+		}
+	}
+	if moved != 0 {
+		t.Errorf("%d keys of surviving servers moved, want 0", moved)
+	}
+}
+
+func TestConsistentHashBoundedLoad(t *testing.T) {
+	key, _ := ParseHashKey("path")
+	servers := manyFakeServers(3)
+	strategy := NewConsistentHashStrategy(key, 0, 0.25)
+	r := pathRequest("/hot")
+	home := strategy.Select(servers, r).(*fakeServer)
+
+	home.inflight = 10
+	if got := strategy.Select(servers, r); got == home {
+		t.Errorf("Select = %s, want another server while %s is over its bound", got.Address(), home.address)
+	}
+}
+
+func TestConsistentHashRebuildsOnWeightChange(t *testing.T) {
+	key, _ := ParseHashKey("path")
+	a, b := NewSimpleServer("http://a"), NewSimpleServer("http://b")
+	servers := []Server{a, b}
+	strategy := NewConsistentHashStrategy(key, 0, 0)
+
+	first := strategy.ringFor(servers)
+	if strategy.ringFor(servers) != first {
+		t.Fatal("ring was rebuilt without a change")
+	}
+	a.SetWeight(3)
+	rebuilt := strategy.ringFor(servers)
+	if rebuilt == first {
+		t.Fatal("ring was not rebuilt after a weight change")
+	}
+	if len(rebuilt.hashes) != 4*len(first.hashes)/2 {
+		t.Errorf("ring has %d nodes, want %d", len(rebuilt.hashes), 4*len(first.hashes)/2)
+	}
+}
+
+func BenchmarkConsistentHashSelect(b *testing.B) {
+	key, _ := ParseHashKey("path")
+	servers := manyFakeServers(300)
+	strategy := NewConsistentHashStrategy(key, 0, 0)
+	r := pathRequest("/bench")
+	b.ResetTimer()
+	for range b.N {
+		strategy.Select(servers, r)
+	}
+}
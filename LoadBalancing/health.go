@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// HealthCheckConfig describes how a backend is actively probed.
+type HealthCheckConfig struct {
+	Path               string        `json:"path"`
+	Interval           time.Duration `json:"interval"`
+	Timeout            time.Duration `json:"timeout"`
+	ExpectedStatusMin  int           `json:"expected_status_min"`
+	ExpectedStatusMax  int           `json:"expected_status_max"`
+	HealthyThreshold   int           `json:"healthy_threshold"`
+	UnhealthyThreshold int           `json:"unhealthy_threshold"`
+}
+
+func DefaultHealthCheckConfig() HealthCheckConfig {
+	return HealthCheckConfig{
+		Path:               "/",
+		Interval:           10 * time.Second,
+		Timeout:            2 * time.Second,
+		ExpectedStatusMin:  200,
+		ExpectedStatusMax:  399,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}
+}
+
+func (c HealthCheckConfig) withDefaults() HealthCheckConfig {
+	d := DefaultHealthCheckConfig()
+	if c.Path == "" {
+		c.Path = d.Path
+	}
+	if c.Interval <= 0 {
+		c.Interval = d.Interval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = d.Timeout
+	}
+	if c.ExpectedStatusMin == 0 && c.ExpectedStatusMax == 0 {
+		c.ExpectedStatusMin, c.ExpectedStatusMax = d.ExpectedStatusMin, d.ExpectedStatusMax
+	}
+	if c.HealthyThreshold <= 0 {
+		c.HealthyThreshold = d.HealthyThreshold
+	}
+	if c.UnhealthyThreshold <= 0 {
+		c.UnhealthyThreshold = d.UnhealthyThreshold
+	}
+	return c
+}
+
+// StartHealthCheck probes the backend in the background until
+// StopHealthCheck is called. Calling it again replaces the running checker.
+func (s *SimpleServer) StartHealthCheck(config HealthCheckConfig) {
+	config = config.withDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.healthMu.Lock()
+	if s.stopHealth != nil {
+		s.stopHealth()
+	}
+	s.stopHealth = cancel
+	s.healthMu.Unlock()
+
+	go s.runHealthCheck(ctx, config)
+}
+
+func (s *SimpleServer) StopHealthCheck() {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	if s.stopHealth != nil {
+		s.stopHealth()
+		s.stopHealth = nil
+	}
+}
+
+func (s *SimpleServer) runHealthCheck(ctx context.Context, config HealthCheckConfig) {
+	// Probes verify the backend the same way proxied requests do.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = s.tlsConfig.Clone()
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   config.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	successes, failures := 0, 0
+	for {
+		err := s.probe(ctx, client, config)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			successes, failures = successes+1, 0
+			if !s.alive.Load() && successes >= config.HealthyThreshold {
+				s.alive.Store(true)
+				fmt.Printf("Health check: %s is back up\n", s.address)
+			}
+		} else {
+			successes, failures = 0, failures+1
+			if s.alive.Load() && failures >= config.UnhealthyThreshold {
+				s.alive.Store(false)
+				fmt.Printf("Health check: %s is down: %v\n", s.address, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *SimpleServer) probe(ctx context.Context, client *http.Client, config HealthCheckConfig) error {
+	probeUrl := *s.url
+	probeUrl.Path = config.Path
+	probeUrl.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < config.ExpectedStatusMin || resp.StatusCode > config.ExpectedStatusMax {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+)
+
+// HedgeConfig sends a second copy of a slow GET or HEAD to another backend.
+// The copy goes out once the first attempt has been waiting longer than the
+// pool's Percentile response time, and at most MaxPercent of requests are
+// hedged.
+type HedgeConfig struct {
+	Percentile float64       `json:"percentile"`
+	MinDelay   time.Duration `json:"min_delay"`
+	MaxPercent float64       `json:"max_percent"`
+}
+
+func DefaultHedgeConfig() HedgeConfig {
+	return HedgeConfig{
+		Percentile: 95,
+		MinDelay:   5 * time.Millisecond,
+		MaxPercent: 10,
+	}
+}
+
+func (c HedgeConfig) withDefaults() HedgeConfig {
+	d := DefaultHedgeConfig()
+	if c.Percentile == 0 {
+		c.Percentile = d.Percentile
+	}
+	if c.MinDelay <= 0 {
+		c.MinDelay = d.MinDelay
+	}
+	if c.MaxPercent == 0 {
+		c.MaxPercent = d.MaxPercent
+	}
+	return c
+}
+
+const (
+	hedgeSamples    = 1000
+	hedgeMinSamples = 20
+)
+
+type HedgePolicy struct {
+	config    HedgeConfig
+	budget    *retryBudget
+	latencies latencyWindow
+}
+
+func NewHedgePolicy(config HedgeConfig) *HedgePolicy {
+	config = config.withDefaults()
+	return &HedgePolicy{
+		config: config,
+		budget: &retryBudget{percent: config.MaxPercent},
+	}
+}
+
+// delay is how long to wait before hedging. It reports false until enough
+// responses have been seen to know what slow means.
+func (h *HedgePolicy) delay() (time.Duration, bool) {
+	d, ok := h.latencies.percentile(h.config.Percentile)
+	return max(d, h.config.MinDelay), ok
+}
+
+func hedgeable(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		!hasBody(r) && r.Header.Get("Upgrade") == ""
+}
+
+// serveTarget proxies r to target, hedging it when the pool is set up for
+// that. It returns the server whose response the client got. With affinity
+// on, the client is bound to that server unless it is already pinned there.
+func (lb *LoadBalancer) serveTarget(w http.ResponseWriter, r *http.Request, target Server, tried []Server, pinned Server) Server {
+	if lb.hedge == nil || !hedgeable(r) {
+		if lb.affinity != nil && target != pinned {
+			lb.affinity.bind(w, target)
+		}
+		target.Serve(w, r)
+		return target
+	}
+	lb.hedge.budget.request()
+
+	race := newHedgeRace(w, lb.hedge, lb.affinity, pinned)
+	primary := race.launch(target, r)
+	delay, ok := lb.hedge.delay()
+	if !ok {
+		<-primary
+		return race.winnerServer(target)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-primary:
+		return race.winnerServer(target)
+	case <-timer.C:
+	}
+
+	if race.decided() {
+		<-primary
+		return race.winnerServer(target)
+	}
+	next := lb.retryTarget(r, append(slices.Clip(tried), target))
+	if next == nil || !lb.hedge.budget.withdraw() {
+		<-primary
+		return race.winnerServer(target)
+	}
+	hedgedRequests.inc(lb.name)
+	backendSelections.inc(lb.name, next.Address())
+	second := race.launch(next, r)
+	<-primary
+	<-second
+	winner := race.winnerServer(target)
+	if winner == next {
+		hedgeWins.inc(lb.name)
+	}
+	return winner
+}
+
+// recoverBackground keeps a panic in a goroutine started by a handler from
+// taking down the balancer; net/http only recovers the handler's own. The
+// proxy aborts with http.ErrAbortHandler when the copy to the client or from
+// a cancelled backend fails, which is expected and not logged.
+func recoverBackground(what string) {
+	if err := recover(); err != nil && err != http.ErrAbortHandler {
+		fmt.Printf("%s: panic: %v\n%s", what, err, debug.Stack())
+	}
+}
+
+// hedgeRace lets the first attempt to produce response headers write to the
+// client and cancels the others. A 5xx only wins if no other attempt is left
+// that could do better.
+//
+// The client's header map belongs to the winner once there is one, so the
+// attempts start from a copy taken before the first of them is launched.
+type hedgeRace struct {
+	w      http.ResponseWriter
+	header http.Header
+	policy *HedgePolicy
+
+	// With affinity on, the client is bound to the winner unless it is
+	// already pinned there.
+	affinity *Affinity
+	pinned   Server
+
+	mu       sync.Mutex
+	attempts []*hedgeWriter
+	pending  int
+	winner   *hedgeWriter
+}
+
+func newHedgeRace(w http.ResponseWriter, policy *HedgePolicy, affinity *Affinity, pinned Server) *hedgeRace {
+	return &hedgeRace{w: w, header: w.Header().Clone(), policy: policy, affinity: affinity, pinned: pinned}
+}
+
+func (race *hedgeRace) launch(server Server, r *http.Request) <-chan struct{} {
+	ctx, cancel := context.WithCancel(r.Context())
+	hw := &hedgeWriter{race: race, server: server, header: race.header.Clone(), cancel: cancel, start: time.Now()}
+	race.mu.Lock()
+	race.attempts = append(race.attempts, hw)
+	race.pending++
+	race.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer cancel()
+		defer recoverBackground("Hedge")
+		// Runs before the recover, so an attempt that panicked ends as a 502.
+		defer hw.finish()
+		server.Serve(hw, r.WithContext(ctx))
+	}()
+	return done
+}
+
+func (race *hedgeRace) decided() bool {
+	race.mu.Lock()
+	defer race.mu.Unlock()
+	return race.winner != nil
+}
+
+func (race *hedgeRace) winnerServer(fallback Server) Server {
+	race.mu.Lock()
+	defer race.mu.Unlock()
+	if race.winner == nil {
+		return fallback
+	}
+	return race.winner.server
+}
+
+type hedgeWriter struct {
+	race   *hedgeRace
+	server Server
+	header http.Header
+	cancel context.CancelFunc
+	start  time.Time
+
+	won  bool
+	lost bool
+}
+
+func (hw *hedgeWriter) Header() http.Header {
+	if hw.won {
+		return hw.race.w.Header()
+	}
+	return hw.header
+}
+
+func (hw *hedgeWriter) WriteHeader(code int) {
+	if code < 200 || hw.won || hw.lost {
+		return
+	}
+	if code < 500 {
+		hw.race.policy.latencies.observe(time.Since(hw.start))
+	}
+
+	race := hw.race
+	race.mu.Lock()
+	if race.winner == nil && (code < 500 || race.pending == 1) {
+		race.winner = hw
+		hw.won = true
+	} else {
+		hw.lost = true
+	}
+	race.pending--
+	race.mu.Unlock()
+
+	if hw.lost {
+		hw.cancel()
+		return
+	}
+	dst := race.w.Header()
+	for key, values := range hw.header {
+		dst[key] = values
+	}
+	if race.affinity != nil && hw.server != race.pinned {
+		race.affinity.bind(race.w, hw.server)
+	}
+	race.w.WriteHeader(code)
+	race.mu.Lock()
+	for _, other := range race.attempts {
+		if other != hw {
+			other.cancel()
+		}
+	}
+	race.mu.Unlock()
+}
+
+func (hw *hedgeWriter) Write(b []byte) (int, error) {
+	if !hw.won && !hw.lost {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if hw.lost {
+		return len(b), nil
+	}
+	return hw.race.w.Write(b)
+}
+
+func (hw *hedgeWriter) Flush() {
+	if hw.won {
+		http.NewResponseController(hw.race.w).Flush()
+	}
+}
+
+// finish settles an attempt that ended without writing a response.
+func (hw *hedgeWriter) finish() {
+	if !hw.won && !hw.lost {
+		hw.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// latencyWindow keeps the most recent response times so percentiles can be
+// taken from them. The sorted copy is refreshed every hedgeMinSamples
+// observations rather than on every request.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	fresh   int
+	sorted  []time.Duration
+}
+
+func (l *latencyWindow) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.samples) < hedgeSamples {
+		l.samples = append(l.samples, d)
+	} else {
+		l.samples[l.next] = d
+		l.next = (l.next + 1) % hedgeSamples
+	}
+	l.fresh++
+}
+
+func (l *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.samples) < hedgeMinSamples {
+		return 0, false
+	}
+	if l.sorted == nil || l.fresh >= hedgeMinSamples {
+		l.sorted = slices.Clone(l.samples)
+		slices.Sort(l.sorted)
+		l.fresh = 0
+	}
+	i := int(float64(len(l.sorted)-1) * p / 100)
+	return l.sorted[i], true
+}
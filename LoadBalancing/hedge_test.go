@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// handlerServer answers in-process with a handler. Like the proxy, the
+// handler must write a status for its response to count.
+type handlerServer struct {
+	fakeServer
+	handler http.HandlerFunc
+}
+
+func (h *handlerServer) Serve(w http.ResponseWriter, r *http.Request) {
+	h.handler(w, r)
+}
+
+// hedgedPool is a pool that hedges after MinDelay, without waiting to learn
+// its latencies first.
+func hedgedPool(servers ...Server) *LoadBalancer {
+	lb := NewLoadBalancer(servers)
+	lb.SetHedge(NewHedgePolicy(HedgeConfig{MinDelay: 5 * time.Millisecond, MaxPercent: 100}))
+	for range hedgeMinSamples {
+		lb.hedge.latencies.observe(time.Millisecond)
+	}
+	return lb
+}
+
+type panickingServer struct {
+	fakeServer
+}
+
+func (p *panickingServer) Serve(http.ResponseWriter, *http.Request) {
+	panic("broken backend response")
+}
+
+func TestHedgeAttemptPanicEndsAs502(t *testing.T) {
+	w := httptest.NewRecorder()
+	race := newHedgeRace(w, NewHedgePolicy(HedgeConfig{}), nil, nil)
+	server := &panickingServer{fakeServer{address: "panics"}}
+
+	<-race.launch(server, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", w.Code)
+	}
+}
+
+func TestHedgeBindsAffinityToWinner(t *testing.T) {
+	slow := &handlerServer{fakeServer{address: "slow", weight: 1}, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}}
+	fast := &handlerServer{fakeServer{address: "fast", weight: 1}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-By", "fast")
+		w.WriteHeader(http.StatusOK)
+	}}
+	lb := hedgedPool(slow, fast)
+	affinity, _ := NewAffinity(AffinityConfig{Mode: "header", Secret: "s"})
+	lb.SetAffinity(affinity)
+
+	w := httptest.NewRecorder()
+	lb.serveProxy(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Header().Get("X-Served-By") != "fast" {
+		t.Fatalf("response came from %q, want the hedged copy", w.Header().Get("X-Served-By"))
+	}
+	if address, ok := affinity.verify(w.Header().Get("X-LB-Affinity")); !ok || address != "fast" {
+		t.Errorf("client pinned to %q, want fast", address)
+	}
+}
+
+// answerOnHedge picks the first server, and lets it answer when it is asked
+// for a server to send the hedged copy to.
+type answerOnHedge struct {
+	picks  int
+	answer chan struct{}
+}
+
+func (s *answerOnHedge) Select(servers []Server, r *http.Request) Server {
+	s.picks++
+	if s.picks == 1 {
+		return servers[0]
+	}
+	close(s.answer)
+	// Give the first server time to write its headers without ordering that
+	// write before the hedge is launched.
+	time.Sleep(2 * time.Millisecond)
+	return servers[1]
+}
+
+// TestHedgeRacingPrimary has the first attempt win while the hedged copy is
+// being launched; run with -race.
+func TestHedgeRacingPrimary(t *testing.T) {
+	strategy := &answerOnHedge{answer: make(chan struct{})}
+	primary := &handlerServer{fakeServer{address: "primary", weight: 1}, func(w http.ResponseWriter, r *http.Request) {
+		<-strategy.answer
+		w.Header().Set("X-Served-By", "primary")
+		w.WriteHeader(http.StatusOK)
+	}}
+	other := &handlerServer{fakeServer{address: "other", weight: 1}, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}}
+	lb := hedgedPool(primary, other)
+	lb.SetStrategy(strategy)
+
+	w := httptest.NewRecorder()
+	lb.serveProxy(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK || w.Header().Get("X-Served-By") != "primary" {
+		t.Errorf("got %d from %q, want 200 from primary", w.Code, w.Header().Get("X-Served-By"))
+	}
+}
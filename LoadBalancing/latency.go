@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultLatencyDecay = 10 * time.Second
+
+// failurePenalty is recorded as the latency of an attempt that ended in a
+// gateway failure, so a backend that fails fast doesn't look fast.
+const failurePenalty = 5 * time.Second
+
+func isGatewayFailure(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// peakEWMA is Finagle's peak exponentially weighted moving average: a slow
+// response raises the estimate immediately, while fast ones only pull it down
+// gradually. Without traffic the estimate decays towards zero, so a backend
+// that was slow once gets retried eventually.
+type peakEWMA struct {
+	mu    sync.Mutex
+	decay time.Duration
+	cost  float64
+	stamp time.Time
+}
+
+func (e *peakEWMA) setDecay(decay time.Duration) {
+	e.mu.Lock()
+	e.decay = decay
+	e.mu.Unlock()
+}
+
+func (e *peakEWMA) observe(rtt time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	sample := float64(rtt)
+	if sample > e.cost {
+		e.cost = sample
+	} else {
+		w := e.weight(now)
+		e.cost = e.cost*w + sample*(1-w)
+	}
+	e.stamp = now
+}
+
+func (e *peakEWMA) value() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return time.Duration(e.cost * e.weight(time.Now()))
+}
+
+func (e *peakEWMA) weight(now time.Time) float64 {
+	decay := e.decay
+	if decay <= 0 {
+		decay = defaultLatencyDecay
+	}
+	elapsed := now.Sub(e.stamp)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Exp(-float64(elapsed) / float64(decay))
+}
+
+// PeakEWMAStrategy is power of two choices over peak-EWMA latency, as used by
+// Finagle and Linkerd: it samples two healthy backends at random and picks
+// the one with the lower latency × in-flight score.
+type PeakEWMAStrategy struct{}
+
+func NewPeakEWMAStrategy() *PeakEWMAStrategy {
+	return &PeakEWMAStrategy{}
+}
+
+func (p *PeakEWMAStrategy) Select(servers []Server, r *http.Request) Server {
+	available := make([]Server, 0, len(servers))
+	for _, server := range servers {
+		if isAvailable(server) {
+			available = append(available, server)
+		}
+	}
+	switch len(available) {
+	case 0:
+		return nil
+	case 1:
+		return available[0]
+	}
+
+	i := rand.IntN(len(available))
+	j := rand.IntN(len(available) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := available[i], available[j]
+	if latencyScore(b) < latencyScore(a) {
+		return b
+	}
+	return a
+}
+
+func latencyScore(s Server) float64 {
+	// The +1 terms keep unmeasured or idle backends comparable by load.
+	return (float64(s.Latency()) + 1) * float64(s.InFlight()+1)
+}
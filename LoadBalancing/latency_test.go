@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPeakEWMAPenalizesFastFailures(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	failing := NewSimpleServer(closed.URL)
+
+	w := httptest.NewRecorder()
+	failing.Serve(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", w.Code)
+	}
+	if got := failing.Latency(); got < failurePenalty/2 {
+		t.Errorf("latency after a refused connection = %s, want about %s", got, failurePenalty)
+	}
+
+	healthy := &fakeServer{address: "healthy", latency: 50 * time.Millisecond}
+	servers := []Server{failing, healthy}
+	counts := pickCounts(NewPeakEWMAStrategy(), servers, 100)
+	if counts["healthy"] != 100 {
+		t.Errorf("picks = %v, want all 100 on the healthy backend", counts)
+	}
+}
+
+func TestPeakEWMAIgnoresCancelledAttempts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+	server := NewSimpleServer(backend.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	server.Serve(httptest.NewRecorder(), r)
+	if got := server.Latency(); got != 0 {
+		t.Errorf("latency after a cancelled attempt = %s, want 0", got)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+)
+
+const defaultMaglevTableSize = 65537
+
+// MaglevStrategy implements Google's Maglev hashing: every server fills slots
+// of a fixed-size lookup table in its own pseudo-random order, so lookups are
+// a single index and each server owns almost exactly 1/N of the table. The
+// table is rebuilt whenever the server set changes.
+type MaglevStrategy struct {
+	key  HashKeyFunc
+	size int
+
+	mu    sync.RWMutex
+	table *maglevTable
+	moved int
+}
+
+type maglevTable struct {
+	set         serverSet
+	fingerprint uint64
+	servers     []Server
+	entries     []int
+}
+
+// NewMaglevStrategy uses a table of at least size entries, rounded up to a
+// prime. It should be much larger than the number of servers.
+func NewMaglevStrategy(key HashKeyFunc, size int) *MaglevStrategy {
+	if size <= 0 {
+		size = defaultMaglevTableSize
+	}
+	return &MaglevStrategy{key: key, size: nextPrime(size)}
+}
+
+// LastMoved reports how many table entries changed owner in the most recent
+// rebuild, i.e. roughly what share of the key space moved.
+func (m *MaglevStrategy) LastMoved() (moved, size int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.moved, m.size
+}
+
+func (m *MaglevStrategy) Select(servers []Server, r *http.Request) Server {
+	table := m.tableFor(servers)
+	if len(table.servers) == 0 {
+		return nil
+	}
+
+	h := hashString(m.key(r))
+	for i := 0; i < 2*len(table.servers); i++ {
+		server := table.servers[table.entries[h%uint64(len(table.entries))]]
+		if isAvailable(server) {
+			return server
+		}
+		h = mix64(h + 1)
+	}
+	for _, server := range table.servers {
+		if isAvailable(server) {
+			return server
+		}
+	}
+	return nil
+}
+
+func (m *MaglevStrategy) tableFor(servers []Server) *maglevTable {
+	set := serverSetOf(servers)
+	m.mu.RLock()
+	table := m.table
+	m.mu.RUnlock()
+	if table != nil && table.set == set {
+		return table
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.table != nil && m.table.set == set {
+		return m.table
+	}
+	fp := fingerprint(servers)
+	if m.table != nil && m.table.fingerprint == fp {
+		// A new slice with the same servers in the same order, e.g. after a
+		// reload that only changed weights, keeps the table.
+		table = &maglevTable{fingerprint: fp, servers: servers, entries: m.table.entries}
+	} else {
+		table = buildMaglevTable(servers, m.size, fp)
+		if m.table != nil {
+			m.moved = countMoved(m.table, table)
+			fmt.Printf("Maglev: rebuilt table for %d servers, %d of %d entries moved\n", len(servers), m.moved, m.size)
+		}
+	}
+	table.set = set
+	m.table = table
+	return table
+}
+
+func buildMaglevTable(servers []Server, size int, fp uint64) *maglevTable {
+	table := &maglevTable{fingerprint: fp, servers: servers, entries: make([]int, size)}
+	if len(servers) == 0 {
+		return table
+	}
+
+	m := uint64(size)
+	offsets := make([]uint64, len(servers))
+	skips := make([]uint64, len(servers))
+	for i, server := range servers {
+		offsets[i] = maglevHash(server.Address(), 0) % m
+		skips[i] = maglevHash(server.Address(), 1)%(m-1) + 1
+	}
+
+	for i := range table.entries {
+		table.entries[i] = -1
+	}
+	next := make([]uint64, len(servers))
+	filled := 0
+	for filled < size {
+		for i := range servers {
+			slot := (offsets[i] + next[i]*skips[i]) % m
+			for table.entries[slot] >= 0 {
+				next[i]++
+				slot = (offsets[i] + next[i]*skips[i]) % m
+			}
+			table.entries[slot] = i
+			next[i]++
+			filled++
+			if filled == size {
+				break
+			}
+		}
+	}
+	return table
+}
+
+func maglevHash(s string, seed byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte{seed})
+	h.Write([]byte(s))
+	return mix64(h.Sum64())
+}
+
+func countMoved(old, rebuilt *maglevTable) int {
+	if len(old.entries) != len(rebuilt.entries) || len(old.servers) == 0 {
+		return len(rebuilt.entries)
+	}
+	moved := 0
+	for i := range rebuilt.entries {
+		if old.servers[old.entries[i]].Address() != rebuilt.servers[rebuilt.entries[i]].Address() {
+			moved++
+		}
+	}
+	return moved
+}
+
+func nextPrime(n int) int {
+	if n < 2 {
+		return 2
+	}
+	for ; ; n++ {
+		prime := true
+		for d := 2; d*d <= n; d++ {
+			if n%d == 0 {
+				prime = false
+				break
+			}
+		}
+		if prime {
+			return n
+		}
+	}
+}
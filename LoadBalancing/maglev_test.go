@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestMaglevSpreadsKeysEvenly(t *testing.T) {
+	key, _ := ParseHashKey("path")
+	servers := manyFakeServers(5)
+	strategy := NewMaglevStrategy(key, 0)
+
+	counts := make(map[Server]int)
+	const keys = 20000
+	for i := range keys {
+		counts[strategy.Select(servers, pathRequest(fmt.Sprintf("/k/%d", i)))]++
+	}
+	for server, n := range counts {
+		if share := float64(n) / keys; math.Abs(share-0.2) > 0.03 {
+			t.Errorf("%s got %.1f%% of keys, want about 20%%", server.Address(), share*100)
+		}
+	}
+}
+
+func TestMaglevRemovalMovesAboutOneNth(t *testing.T) {
+	key, _ := ParseHashKey("path")
+	servers := manyFakeServers(10)
+	strategy := NewMaglevStrategy(key, 0)
+	strategy.Select(servers, pathRequest("/"))
+	strategy.Select(servers[:9], pathRequest("/"))
+
+	moved, size := strategy.LastMoved()
+	if share := float64(moved) / float64(size); share < 0.08 || share > 0.15 {
+		t.Errorf("%.1f%% of entries moved, want about 10%%", share*100)
+	}
+}
+
+func TestMaglevKeepsTableForSameServers(t *testing.T) {
+	key, _ := ParseHashKey("path")
+	servers := manyFakeServers(4)
+	strategy := NewMaglevStrategy(key, 0)
+	table := strategy.tableFor(servers)
+
+	if strategy.tableFor(servers) != table {
+		t.Fatal("table was rebuilt without a change")
+	}
+	servers[0].(*fakeServer).weight = 5
+	reloaded := strategy.tableFor(slices.Clone(servers))
+	if &reloaded.entries[0] != &table.entries[0] {
+		t.Error("entries were rebuilt for the same servers")
+	}
+}
+
+func BenchmarkMaglevSelect(b *testing.B) {
+	key, _ := ParseHashKey("path")
+	servers := manyFakeServers(300)
+	strategy := NewMaglevStrategy(key, 0)
+	r := pathRequest("/bench")
+	b.ResetTimer()
+	for range b.N {
+		strategy.Select(servers, r)
+	}
+}
@@ -1,31 +1,79 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type SimpleServer struct {
-	address string
-	proxy   *httputil.ReverseProxy
+	address   string
+	pool      string
+	url       *url.URL
+	tags      atomic.Pointer[[]string]
+	proxy     *httputil.ReverseProxy
+	transport *http.Transport
+	tlsConfig *tls.Config
+	alive     atomic.Bool
+	outlier   atomic.Pointer[outlierTracker]
+	breaker   atomic.Pointer[circuitBreaker]
+
+	inflight atomic.Int64
+	requests atomic.Uint64
+	draining atomic.Bool
+	lifetime atomic.Pointer[lifetime]
+	weight   atomic.Int64
+	latency  peakEWMA
+
+	healthMu   sync.Mutex
+	stopHealth func()
+
+	drainMu    sync.Mutex
+	drainTimer *time.Timer
 }
 
 type Server interface {
 	Address() string
 	IsAlive() bool
+	Draining() bool
+	InFlight() int64
+	Weight() int
+	Latency() time.Duration
 	Serve(http.ResponseWriter, *http.Request)
 }
 
 func NewSimpleServer(address string) *SimpleServer {
 	serverUrl, err := url.Parse(address)
 	handleError(err)
-	return &SimpleServer{
-		address: address,
-		proxy:   httputil.NewSingleHostReverseProxy(serverUrl),
+	server := &SimpleServer{
+		address:   address,
+		url:       serverUrl,
+		proxy:     httputil.NewSingleHostReverseProxy(serverUrl),
+		transport: http.DefaultTransport.(*http.Transport).Clone(),
 	}
+	server.proxy.Transport = server.transport
+	server.proxy.ModifyResponse = server.modifyResponse
+	server.proxy.ErrorHandler = server.handleProxyError
+	server.alive.Store(true)
+	server.weight.Store(1)
+	server.lifetime.Store(newLifetime())
+	return server
 }
 
 func handleError(err error) {
@@ -40,56 +88,429 @@ func (s *SimpleServer) Address() string {
 }
 
 func (s *SimpleServer) IsAlive() bool {
-	return true
+	return s.alive.Load() && !s.isEjected()
+}
+
+func (s *SimpleServer) InFlight() int64 {
+	return s.inflight.Load()
+}
+
+// Requests is the number of requests the server has been sent.
+func (s *SimpleServer) Requests() uint64 {
+	return s.requests.Load()
+}
+
+func (s *SimpleServer) Weight() int {
+	return int(s.weight.Load())
+}
+
+// SetWeight changes the server's share of traffic for weighted strategies.
+// A weight of zero takes it out of weighted rotation.
+func (s *SimpleServer) SetWeight(weight int) {
+	if s.weight.Swap(int64(weight)) != int64(weight) {
+		weightChanges.Add(1)
+	}
+}
+
+func (s *SimpleServer) Tags() []string {
+	if tags := s.tags.Load(); tags != nil {
+		return *tags
+	}
+	return nil
+}
+
+// SetTags labels the server; tags are informational only.
+func (s *SimpleServer) SetTags(tags []string) {
+	s.tags.Store(&tags)
+}
+
+// SetUpstreamTimeouts bounds how long connecting to the backend and waiting
+// for its response headers may take. Zero keeps the transport's default.
+func (s *SimpleServer) SetUpstreamTimeouts(connect, responseHeader time.Duration) {
+	if connect > 0 {
+		s.transport.DialContext = (&net.Dialer{
+			Timeout:   connect,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	s.transport.ResponseHeaderTimeout = responseHeader
+}
+
+// Latency is the server's peak-EWMA response time.
+func (s *SimpleServer) Latency() time.Duration {
+	return s.latency.value()
+}
+
+// SetLatencyDecay sets how quickly old latency samples are forgotten.
+func (s *SimpleServer) SetLatencyDecay(decay time.Duration) {
+	s.latency.setDecay(decay)
 }
 
 func (s *SimpleServer) Serve(w http.ResponseWriter, r *http.Request) {
-	s.proxy.ServeHTTP(w, r)
+	breaker := s.breaker.Load()
+	probe, ok := breaker.acquire()
+	if !ok {
+		breakerRejections.inc(s.pool, s.address)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	recorder := &statusRecorder{ResponseWriter: w}
+	ctx, cancel := s.withLifetime(r.Context())
+	defer cancel()
+	// Deferred because the proxy panics when a response body copy fails.
+	defer func() {
+		if ctx.Err() != nil {
+			breaker.abandon(probe)
+		} else {
+			breaker.release(probe, recorder.status >= 500)
+		}
+	}()
+	s.requests.Add(1)
+	s.inflight.Add(1)
+	defer s.inflight.Add(-1)
+	start := time.Now()
+	s.proxy.ServeHTTP(recorder, r.WithContext(ctx))
+	elapsed := time.Since(start)
+	// A cancelled attempt says nothing about the backend.
+	if ctx.Err() == nil {
+		if isGatewayFailure(recorder.status) {
+			s.latency.observe(max(elapsed, failurePenalty))
+		} else {
+			s.latency.observe(elapsed)
+		}
+	}
+	backendRequests.inc(s.pool, s.address, statusClass(recorder.status))
+	backendLatency.observe(elapsed.Seconds(), s.pool, s.address)
+}
+
+// NoHealthyUpstreamError is returned when a full pass over the pool found no
+// backend that is alive.
+type NoHealthyUpstreamError struct {
+	Servers int
+}
+
+func (e *NoHealthyUpstreamError) Error() string {
+	return fmt.Sprintf("no healthy upstream among %d servers", e.Servers)
 }
 
 type LoadBalancer struct {
-	port            string
-	roundRobinCount int
-	servers         []Server
+	name      string
+	strategy  Strategy
+	affinity  *Affinity
+	outliers  *OutlierDetector
+	accessLog *AccessLogger
+	retry     *RetryPolicy
+	hedge     *HedgePolicy
+	mirror    *Mirror
+	servers   atomic.Pointer[[]Server]
+
+	retryAfter      time.Duration
+	unavailableBody string
 }
 
-func NewLoadBalancer(port string, servers []Server) *LoadBalancer {
-	return &LoadBalancer{
-		port:            port,
-		roundRobinCount: 0,
-		servers:         servers,
+func NewLoadBalancer(servers []Server) *LoadBalancer {
+	lb := &LoadBalancer{
+		strategy:        NewRoundRobinStrategy(),
+		retryAfter:      5 * time.Second,
+		unavailableBody: "no healthy upstream\n",
 	}
+	lb.servers.Store(&servers)
+	return lb
+}
+
+// Servers returns the live backend set. The slice must not be modified.
+func (lb *LoadBalancer) Servers() []Server {
+	return *lb.servers.Load()
+}
+
+// SetServers atomically replaces the backend set. Requests already being
+// proxied finish on the server they were sent to.
+func (lb *LoadBalancer) SetServers(servers []Server) {
+	lb.servers.Store(&servers)
+}
+
+// SetUnavailableResponse configures the 503 sent when no backend is alive.
+func (lb *LoadBalancer) SetUnavailableResponse(retryAfter time.Duration, body string) {
+	lb.retryAfter = retryAfter
+	lb.unavailableBody = body
+}
+
+// SetStrategy replaces the default round robin. It must be called before the
+// balancer starts serving.
+func (lb *LoadBalancer) SetStrategy(strategy Strategy) {
+	lb.strategy = strategy
+}
+
+// SetAffinity enables sticky sessions. It must be called before the balancer
+// starts serving.
+func (lb *LoadBalancer) SetAffinity(affinity *Affinity) {
+	lb.affinity = affinity
+}
+
+// SetAccessLog sends one entry per request to l; nil turns logging off. It
+// must be called before the balancer starts serving.
+func (lb *LoadBalancer) SetAccessLog(l *AccessLogger) {
+	lb.accessLog = l
+}
+
+// SetRetry enables retrying failed requests on other backends; nil turns
+// retries off. It must be called before the balancer starts serving.
+func (lb *LoadBalancer) SetRetry(policy *RetryPolicy) {
+	lb.retry = policy
+}
+
+// SetHedge enables hedged GET and HEAD requests; nil turns hedging off. It
+// must be called before the balancer starts serving.
+func (lb *LoadBalancer) SetHedge(policy *HedgePolicy) {
+	lb.hedge = policy
 }
 
-func (lb *LoadBalancer) getNextAvailableServer() Server {
-	server := lb.servers[lb.roundRobinCount%len(lb.servers)]
-	lb.roundRobinCount = (lb.roundRobinCount + 1) % len(lb.servers)
-	if server.IsAlive() {
-		return server
+// SetMirror copies sampled requests to a shadow pool; nil turns mirroring
+// off. It must be called before the balancer starts serving.
+func (lb *LoadBalancer) SetMirror(mirror *Mirror) {
+	lb.mirror = mirror
+}
+
+func (lb *LoadBalancer) getNextAvailableServer(r *http.Request) (Server, error) {
+	servers := lb.Servers()
+	if server := lb.strategy.Select(servers, r); server != nil {
+		return server, nil
 	}
 
-	return lb.getNextAvailableServer()
+	return nil, &NoHealthyUpstreamError{Servers: len(servers)}
 }
 
 func (lb *LoadBalancer) serveProxy(w http.ResponseWriter, r *http.Request) {
-	target := lb.getNextAvailableServer()
-	fmt.Printf("Forwarding request to address: %s\n", target.Address())
-	target.Serve(w, r)
+	entry := &accessEntry{
+		Time:      time.Now(),
+		RequestID: requestID(w, r),
+		ClientIP:  clientIP(r),
+		Method:    r.Method,
+		Host:      r.Host,
+		Path:      r.URL.RequestURI(),
+		Proto:     r.Proto,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		Pool:      lb.name,
+		Backend:   "-",
+	}
+	body := &countingReader{ReadCloser: r.Body}
+	r.Body = body
+	recorder := &statusRecorder{ResponseWriter: w}
+	defer func() {
+		entry.Status = recorder.status
+		entry.BytesIn = body.n
+		entry.BytesOut = recorder.bytes
+		entry.Total = time.Since(entry.Time)
+		if lb.accessLog != nil {
+			lb.accessLog.Log(entry)
+		}
+	}()
+
+	// pinned is the server the client's affinity token names, if any.
+	var target, pinned Server
+	if lb.affinity != nil {
+		target = lb.affinity.lookup(r, lb.Servers())
+		pinned = target
+	}
+	if target == nil {
+		var err error
+		target, err = lb.getNextAvailableServer(r)
+		if err != nil {
+			noHealthyUpstream.inc(lb.name)
+			lb.serveUnavailable(recorder)
+			return
+		}
+	}
+
+	lb.mirror.mirror(lb.name, r)
+	retries, payload := lb.retry.prepare(r)
+	tried := make([]Server, 0, retries+1)
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		backendSelections.inc(lb.name, target.Address())
+		entry.Backend = target.Address()
+		tried = append(tried, target)
+		if payload != nil {
+			r.Body = io.NopCloser(bytes.NewReader(payload))
+		}
+
+		if attempt == retries {
+			target = lb.serveTarget(recorder, r, target, tried, pinned)
+			entry.Backend = target.Address()
+			break
+		}
+		writer := newRetryWriter(recorder, int(lb.retry.config.MaxBodyBytes))
+		if served := lb.serveTarget(writer, r, target, tried, pinned); served != target {
+			target = served
+			entry.Backend = target.Address()
+			tried = append(tried, target)
+		}
+		if !writer.failed() || r.Context().Err() != nil {
+			writer.release()
+			break
+		}
+
+		next := lb.retryTarget(r, tried)
+		if next == nil {
+			writer.release()
+			break
+		}
+		if !lb.retry.budget.withdraw() {
+			retryBudgetExhausted.inc(lb.name)
+			writer.release()
+			break
+		}
+		if !lb.retry.wait(r.Context(), attempt) {
+			writer.release()
+			break
+		}
+		retriedRequests.inc(lb.name)
+		target = next
+	}
+	entry.Upstream = time.Since(start)
+	if !recorder.headerAt.IsZero() {
+		entry.Upstream = recorder.headerAt.Sub(start)
+	}
+}
+
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lb.serveProxy(w, r)
+}
+
+func (lb *LoadBalancer) serveUnavailable(w http.ResponseWriter) {
+	if lb.retryAfter > 0 {
+		seconds := int(math.Ceil(lb.retryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	io.WriteString(w, lb.unavailableBody)
 }
 
 func main() {
-	servers := []Server{
-		NewSimpleServer("https://daryo.uz"),
-		NewSimpleServer("https://kun.uz"),
-		NewSimpleServer("https://afisha.uz"),
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
+	}
+
+	configPath := flag.String("config", "", "path to a YAML or JSON config file")
+	watch := flag.Duration("watch", 0, "reload the config file when it changes, polling at this interval")
+	flag.Parse()
+
+	config := defaultConfig()
+	if *configPath != "" {
+		var err error
+		config, err = LoadConfig(*configPath)
+		handleError(err)
+	}
+	pools, err := config.BuildPools()
+	handleError(err)
+
+	var accessLogConfig AccessLogConfig
+	if config.AccessLog != nil {
+		accessLogConfig = *config.AccessLog
+	}
+	accessLog, err := NewAccessLogger(accessLogConfig)
+	handleError(err)
+	for _, lb := range pools {
+		lb.SetAccessLog(accessLog)
+	}
+
+	routers := make([]*Router, len(config.Listeners))
+	for i, listener := range config.Listeners {
+		routers[i], err = config.BuildRouter(listener, pools)
+		handleError(err)
+	}
+
+	certs := make(map[string]*CertStore)
+	for _, listener := range config.Listeners {
+		if listener.TLS != nil {
+			certs[listener.Address], err = NewCertStore(*listener.TLS)
+			handleError(err)
+		}
+	}
+
+	reloader := NewReloader(config, pools, routers, certs)
+	if *configPath != "" {
+		reloader.WatchSignals()
+		if *watch > 0 {
+			reloader.WatchFile(*watch)
+		}
 	}
 
-	lb := NewLoadBalancer(":8000", servers)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var servers []*http.Server
+	errs := make(chan error, len(config.Listeners)+1)
+	serve := func(server *http.Server) {
+		servers = append(servers, server)
+		go func() {
+			var err error
+			if server.TLSConfig != nil {
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				err = server.ListenAndServe()
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				errs <- err
+			}
+		}()
+	}
+	if config.Admin != nil {
+		admin := NewAdminServer(reloader, pools)
+		serve(&http.Server{Addr: config.Admin.Address, Handler: admin.Handler()})
+		fmt.Printf("Admin API listening on %s\n", config.Admin.Address)
+	}
+	for i, listener := range config.Listeners {
+		var handler http.Handler = routers[i]
+		description := routers[i].String()
+		if listener.RedirectHTTPS > 0 {
+			handler = redirectHTTPS(listener.RedirectHTTPS)
+			description = fmt.Sprintf("redirecting to HTTPS port %d", listener.RedirectHTTPS)
+		}
+		server := config.NewHTTPServer(listener, handler)
+		scheme := "http"
+		if store := certs[listener.Address]; store != nil {
+			server.TLSConfig = store.TLSConfig()
+			scheme = "https"
+		}
+		serve(server)
+		fmt.Printf("Load balancer listening on %s://%s (%s)\n", scheme, listener.Address, description)
+	}
+
+	select {
+	case err := <-errs:
+		handleError(err)
+	case <-ctx.Done():
+	}
+	// A second signal kills the process without waiting.
+	stop()
+	fmt.Println("Shutting down, waiting for in-flight requests")
+	err = shutdown(servers, pools, config.Timeouts.Shutdown)
+	accessLog.Close()
+	handleError(err)
+	fmt.Println("Shutdown complete")
+}
+
+// runValidate implements "validate [-config] FILE": it checks a config file
+// without starting anything.
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to a YAML or JSON config file")
+	flags.Parse(args)
+	if *configPath == "" && flags.NArg() == 1 {
+		*configPath = flags.Arg(0)
+	}
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: validate [-config] FILE")
+		return 2
+	}
 
-	handleRedirect := func(w http.ResponseWriter, r *http.Request) {
-		lb.serveProxy(w, r)
+	if _, err := LoadConfig(*configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
-	http.HandleFunc("/", handleRedirect)
-	fmt.Printf("Load balancer started at localhost%s\n", lb.port)
-	handleError(http.ListenAndServe(lb.port, nil))
+	fmt.Printf("%s: OK\n", *configPath)
+	return 0
 }
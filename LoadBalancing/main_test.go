@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// startBackends starts n backends that answer 200 and count their requests.
+func startBackends(t *testing.T, n int) ([]Server, []*atomic.Int64) {
+	t.Helper()
+	servers := make([]Server, n)
+	hits := make([]*atomic.Int64, n)
+	for i := range servers {
+		count := &atomic.Int64{}
+		hits[i] = count
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			count.Add(1)
+			w.Header().Set("X-Backend", strconv.Itoa(i))
+		}))
+		t.Cleanup(backend.Close)
+		servers[i] = NewSimpleServer(backend.URL)
+	}
+	return servers, hits
+}
+
+func TestServeProxyConcurrentRoundRobin(t *testing.T) {
+	const workers, perWorker = 30, 30
+	servers, hits := startBackends(t, 3)
+	lb := NewLoadBalancer(servers)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perWorker {
+				w := httptest.NewRecorder()
+				lb.serveProxy(w, httptest.NewRequest(http.MethodGet, "/", nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("status = %d, want 200", w.Code)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := int64(workers * perWorker / len(servers))
+	for i, count := range hits {
+		if got := count.Load(); got != want {
+			t.Errorf("backend %d got %d requests, want %d", i, got, want)
+		}
+	}
+}
+
+func TestServeProxyNoHealthyUpstream(t *testing.T) {
+	servers, hits := startBackends(t, 2)
+	for _, server := range servers {
+		server.(*SimpleServer).alive.Store(false)
+	}
+	lb := NewLoadBalancer(servers)
+
+	w := httptest.NewRecorder()
+	lb.serveProxy(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+	for i, count := range hits {
+		if count.Load() != 0 {
+			t.Errorf("backend %d was sent a request", i)
+		}
+	}
+}
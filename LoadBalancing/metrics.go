@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small Prometheus text-format registry; the client library would be the
+// project's first dependency.
+var registry = &metricRegistry{}
+
+var (
+	routeRequests = registry.counter("lb_route_requests_total",
+		"Requests received by a listener, by the route they matched.", "listener", "route")
+	splitRequests = registry.counter("lb_split_requests_total",
+		"Requests on a split route, by the pool they went to and status class.", "route", "variant", "code")
+	splitLatency = registry.histogram("lb_split_request_duration_seconds",
+		"Time to serve requests on a split route, by the pool they went to.", "route", "variant")
+	backendRequests = registry.counter("lb_backend_requests_total",
+		"Requests proxied to a backend, by status class.", "pool", "backend", "code")
+	backendProxyErrors = registry.counter("lb_backend_proxy_errors_total",
+		"Requests the proxy could not complete with a backend, by cause: canceled, timeout or error.", "pool", "backend", "cause")
+	backendLatency = registry.histogram("lb_backend_request_duration_seconds",
+		"Time from forwarding a request to the backend until its response was copied.", "pool", "backend")
+	backendInFlight = registry.gauge("lb_backend_in_flight_requests",
+		"Requests currently being proxied to a backend.", "pool", "backend")
+	backendHealthy = registry.gauge("lb_backend_healthy",
+		"1 if the backend passes health checks and is not ejected.", "pool", "backend")
+	backendAvailable = registry.gauge("lb_backend_available",
+		"1 if the backend can be selected: healthy, not ejected and not draining.", "pool", "backend")
+	backendSelections = registry.counter("lb_backend_selections_total",
+		"Times the balancing strategy picked a backend.", "pool", "backend")
+	noHealthyUpstream = registry.counter("lb_no_healthy_upstream_total",
+		"Requests answered with 503 because no backend was available.", "pool")
+	outlierEjections = registry.counter("lb_outlier_ejections_total",
+		"Backends ejected by outlier detection.", "pool", "backend")
+	backendBreakerState = registry.gauge("lb_backend_breaker_state",
+		"1 for the state the backend's circuit breaker is in.", "pool", "backend", "state")
+	breakerTransitions = registry.counter("lb_breaker_transitions_total",
+		"Circuit breaker state changes, by the state entered.", "pool", "backend", "state")
+	breakerRejections = registry.counter("lb_breaker_rejections_total",
+		"Requests turned away by a backend's circuit breaker.", "pool", "backend")
+	hedgedRequests = registry.counter("lb_hedged_requests_total",
+		"Requests sent to a second backend because the first was slow.", "pool")
+	hedgeWins = registry.counter("lb_hedge_wins_total",
+		"Hedged requests answered by the second backend.", "pool")
+	mirrorRequests = registry.counter("lb_mirror_requests_total",
+		"Copies of requests sent to a shadow pool, by the shadow's status class.", "pool", "shadow", "code")
+	mirrorLatency = registry.histogram("lb_mirror_request_duration_seconds",
+		"Time the shadow pool took to answer a mirrored request.", "pool", "shadow")
+	mirrorSkipped = registry.counter("lb_mirror_skipped_total",
+		"Sampled requests that were not mirrored, by reason.", "pool", "reason")
+	retriedRequests = registry.counter("lb_retries_total",
+		"Requests sent again to another backend after a failed attempt.", "pool")
+	retryBudgetExhausted = registry.counter("lb_retry_budget_exhausted_total",
+		"Retries skipped because the pool's retry budget was used up.", "pool")
+)
+
+var defaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricRegistry struct {
+	families []*metricFamily
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func (m *metricRegistry) add(name, help, kind string, labels []string) *metricFamily {
+	f := &metricFamily{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*metricSeries)}
+	m.families = append(m.families, f)
+	return f
+}
+
+func (m *metricRegistry) counter(name, help string, labels ...string) *metricFamily {
+	return m.add(name, help, "counter", labels)
+}
+
+func (m *metricRegistry) gauge(name, help string, labels ...string) *metricFamily {
+	return m.add(name, help, "gauge", labels)
+}
+
+func (m *metricRegistry) histogram(name, help string, labels ...string) *metricFamily {
+	return m.add(name, help, "histogram", labels)
+}
+
+// get must be called with f.mu held.
+func (f *metricFamily) get(labels []string) *metricSeries {
+	key := strings.Join(labels, "\x00")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labels: append([]string(nil), labels...)}
+		if f.kind == "histogram" {
+			s.buckets = make([]uint64, len(defaultLatencyBuckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *metricFamily) inc(labels ...string) {
+	f.add(1, labels...)
+}
+
+func (f *metricFamily) add(v float64, labels ...string) {
+	f.mu.Lock()
+	f.get(labels).value += v
+	f.mu.Unlock()
+}
+
+func (f *metricFamily) set(v float64, labels ...string) {
+	f.mu.Lock()
+	f.get(labels).value = v
+	f.mu.Unlock()
+}
+
+func (f *metricFamily) observe(v float64, labels ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.get(labels)
+	for i, bound := range defaultLatencyBuckets {
+		if v <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (f *metricFamily) reset() {
+	f.mu.Lock()
+	f.series = make(map[string]*metricSeries)
+	f.mu.Unlock()
+}
+
+func (m *metricRegistry) writeTo(w io.Writer) {
+	for _, f := range m.families {
+		f.writeTo(w)
+	}
+}
+
+func (f *metricFamily) writeTo(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.series) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	leNames := append(append([]string(nil), f.labels...), "le")
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, s.labels), formatValue(s.value))
+			continue
+		}
+		le := func(bound string) string {
+			return formatLabels(leNames, append(append([]string(nil), s.labels...), bound))
+		}
+		for i, bound := range defaultLatencyBuckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, le(formatValue(bound)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, le("+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labels), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.labels), s.count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = name + `="` + value + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "other"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// metricsHandler serves /metrics. Gauges that describe current state are
+// refreshed from the pools on every scrape, so removed backends disappear.
+func metricsHandler(pools map[string]*LoadBalancer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		backendInFlight.reset()
+		backendHealthy.reset()
+		backendAvailable.reset()
+		backendBreakerState.reset()
+		for name, lb := range pools {
+			for _, server := range lb.Servers() {
+				backendInFlight.set(float64(server.InFlight()), name, server.Address())
+				backendHealthy.set(boolMetric(server.IsAlive()), name, server.Address())
+				backendAvailable.set(boolMetric(isAvailable(server)), name, server.Address())
+				if s, ok := server.(*SimpleServer); ok {
+					if current := s.BreakerState(); current != "" {
+						for _, state := range breakerStates {
+							backendBreakerState.set(boolMetric(state == current), name, server.Address(), state)
+						}
+					}
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registry.writeTo(w)
+	}
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// statusRecorder remembers the status code and size of the response written
+// through it, and when the headers went out.
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	headerAt time.Time
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 && code >= 200 {
+		r.status = code
+		r.headerAt = time.Now()
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+		r.headerAt = time.Now()
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Flush() {
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
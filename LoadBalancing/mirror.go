@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// MirrorConfig copies a sample of a pool's requests to a shadow pool, e.g.
+// to try a new version on real traffic before cutting over. Shadow responses
+// are thrown away; only their status and latency are recorded.
+type MirrorConfig struct {
+	Pool          string        `json:"pool"`
+	Percent       float64       `json:"percent"`
+	MaxBodyBytes  int64         `json:"max_body_bytes"`
+	MaxConcurrent int           `json:"max_concurrent"`
+	Timeout       time.Duration `json:"timeout"`
+}
+
+func DefaultMirrorConfig() MirrorConfig {
+	return MirrorConfig{
+		Percent:       10,
+		MaxBodyBytes:  64 << 10,
+		MaxConcurrent: 32,
+		Timeout:       30 * time.Second,
+	}
+}
+
+func (c MirrorConfig) withDefaults() MirrorConfig {
+	d := DefaultMirrorConfig()
+	if c.Percent == 0 {
+		c.Percent = d.Percent
+	}
+	if c.MaxBodyBytes == 0 {
+		c.MaxBodyBytes = d.MaxBodyBytes
+	}
+	if c.MaxConcurrent == 0 {
+		c.MaxConcurrent = d.MaxConcurrent
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = d.Timeout
+	}
+	return c
+}
+
+type Mirror struct {
+	config MirrorConfig
+	shadow *LoadBalancer
+	slots  chan struct{}
+}
+
+func NewMirror(config MirrorConfig, shadow *LoadBalancer) *Mirror {
+	config = config.withDefaults()
+	return &Mirror{config: config, shadow: shadow, slots: make(chan struct{}, config.MaxConcurrent)}
+}
+
+// mirror sends a copy of r to the shadow pool in the background if r is
+// sampled. The body is read so both copies can have it; a body over the
+// size limit is passed on untouched and the request is not mirrored.
+func (m *Mirror) mirror(pool string, r *http.Request) {
+	if m == nil || rand.Float64()*100 >= m.config.Percent {
+		return
+	}
+	var body []byte
+	if hasBody(r) {
+		if r.ContentLength > m.config.MaxBodyBytes {
+			mirrorSkipped.inc(pool, "body_too_large")
+			return
+		}
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, m.config.MaxBodyBytes+1))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if err != nil || int64(len(body)) > m.config.MaxBodyBytes {
+			mirrorSkipped.inc(pool, "body_too_large")
+			return
+		}
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		mirrorSkipped.inc(pool, "concurrency")
+		return
+	}
+
+	// The shadow request outlives the client's so its latency is measured
+	// in full.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), m.config.Timeout)
+	shadow := r.Clone(ctx)
+	shadow.Body = io.NopCloser(bytes.NewReader(body))
+	go func() {
+		defer func() { <-m.slots }()
+		defer cancel()
+		defer recoverBackground("Mirror")
+
+		server, err := m.shadow.getNextAvailableServer(shadow)
+		if err != nil {
+			mirrorSkipped.inc(pool, "no_healthy_upstream")
+			return
+		}
+		recorder := &statusRecorder{ResponseWriter: discardResponse{header: http.Header{}}}
+		start := time.Now()
+		server.Serve(recorder, shadow)
+		mirrorRequests.inc(pool, m.shadow.name, statusClass(recorder.status))
+		mirrorLatency.observe(time.Since(start).Seconds(), pool, m.shadow.name)
+	}()
+}
+
+type discardResponse struct {
+	header http.Header
+}
+
+func (d discardResponse) Header() http.Header         { return d.header }
+func (d discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (d discardResponse) WriteHeader(int)             {}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMirrorSurvivesShadowPanic(t *testing.T) {
+	shadow := NewLoadBalancer([]Server{&panickingServer{fakeServer{address: "panics"}}})
+	shadow.name = "shadow"
+	m := NewMirror(MirrorConfig{Pool: "shadow", Percent: 100}, shadow)
+
+	m.mirror("live", httptest.NewRequest(http.MethodGet, "/", nil))
+	deadline := time.Now().Add(time.Second)
+	for len(m.slots) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("mirrored request never finished")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// OutlierConfig controls passive health checking: backends that fail real
+// traffic are ejected for a while, the way Envoy's outlier detection does.
+type OutlierConfig struct {
+	Consecutive5xx             int           `json:"consecutive_5xx"`
+	ConsecutiveGatewayFailures int           `json:"consecutive_gateway_failures"`
+	BaseEjectionTime           time.Duration `json:"base_ejection_time"`
+	MaxEjectionTime            time.Duration `json:"max_ejection_time"`
+	MaxEjectionPercent         int           `json:"max_ejection_percent"`
+}
+
+func DefaultOutlierConfig() OutlierConfig {
+	return OutlierConfig{
+		Consecutive5xx:             5,
+		ConsecutiveGatewayFailures: 3,
+		BaseEjectionTime:           30 * time.Second,
+		MaxEjectionTime:            5 * time.Minute,
+		MaxEjectionPercent:         50,
+	}
+}
+
+// OutlierDetector tracks every backend of one pool so it can cap how many of
+// them are ejected at the same time.
+type OutlierDetector struct {
+	config OutlierConfig
+
+	mu      sync.Mutex
+	servers int
+	ejected int
+}
+
+func NewOutlierDetector(config OutlierConfig) *OutlierDetector {
+	return &OutlierDetector{config: config}
+}
+
+func (d *OutlierDetector) Attach(s *SimpleServer) {
+	d.mu.Lock()
+	d.servers++
+	d.mu.Unlock()
+	s.outlier.Store(&outlierTracker{detector: d})
+}
+
+func (d *OutlierDetector) Detach(s *SimpleServer) {
+	t := s.outlier.Swap(nil)
+	if t == nil || t.detector != d {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.servers--
+	if t.ejected {
+		t.ejected = false
+		d.ejected--
+	}
+}
+
+func (d *OutlierDetector) tryEject() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	limit := d.servers * d.config.MaxEjectionPercent / 100
+	if limit < 1 && d.config.MaxEjectionPercent > 0 {
+		limit = 1
+	}
+	if d.ejected >= limit {
+		return false
+	}
+	d.ejected++
+	return true
+}
+
+func (d *OutlierDetector) release() {
+	d.mu.Lock()
+	d.ejected--
+	d.mu.Unlock()
+}
+
+type outlierTracker struct {
+	detector *OutlierDetector
+
+	mu               sync.Mutex
+	consecutive5xx   int
+	consecutiveFails int
+	ejections        int
+	ejected          bool
+	ejectedUntil     time.Time
+}
+
+func (t *outlierTracker) isEjected(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ejected && !now.Before(t.ejectedUntil) {
+		t.ejected = false
+		t.detector.release()
+	}
+	return t.ejected
+}
+
+func (t *outlierTracker) record(s *SimpleServer, status int, gatewayFailure bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	config := t.detector.config
+	switch {
+	case gatewayFailure:
+		t.consecutiveFails++
+		t.consecutive5xx++
+	case status >= 500:
+		t.consecutiveFails = 0
+		t.consecutive5xx++
+	default:
+		t.consecutiveFails = 0
+		t.consecutive5xx = 0
+		// Each healthy base ejection period forgives one earlier ejection.
+		now := time.Now()
+		if !t.ejected && t.ejections > 0 && now.After(t.ejectedUntil.Add(config.BaseEjectionTime)) {
+			t.ejections--
+			t.ejectedUntil = now
+		}
+		return
+	}
+
+	if t.ejected {
+		return
+	}
+	trip := (config.ConsecutiveGatewayFailures > 0 && t.consecutiveFails >= config.ConsecutiveGatewayFailures) ||
+		(config.Consecutive5xx > 0 && t.consecutive5xx >= config.Consecutive5xx)
+	if !trip || !t.detector.tryEject() {
+		return
+	}
+
+	t.ejections++
+	backoff := config.BaseEjectionTime * time.Duration(t.ejections)
+	if config.MaxEjectionTime > 0 && backoff > config.MaxEjectionTime {
+		backoff = config.MaxEjectionTime
+	}
+	t.ejected = true
+	t.ejectedUntil = time.Now().Add(backoff)
+	t.consecutiveFails, t.consecutive5xx = 0, 0
+	outlierEjections.inc(s.pool, s.address)
+	fmt.Printf("Outlier detection: ejecting %s for %s\n", s.address, backoff)
+}
+
+func (s *SimpleServer) isEjected() bool {
+	t := s.outlier.Load()
+	return t != nil && t.isEjected(time.Now())
+}
+
+func (s *SimpleServer) modifyResponse(resp *http.Response) error {
+	if t := s.outlier.Load(); t != nil {
+		t.record(s, resp.StatusCode, false)
+	}
+	return nil
+}
+
+func (s *SimpleServer) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if !errors.Is(err, context.Canceled) {
+		if t := s.outlier.Load(); t != nil {
+			t.record(s, http.StatusBadGateway, true)
+		}
+	}
+	backendProxyErrors.inc(s.pool, s.address, proxyErrorCause(err))
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func proxyErrorCause(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "error"
+}
+
+func (c OutlierConfig) withDefaults() OutlierConfig {
+	d := DefaultOutlierConfig()
+	if c.Consecutive5xx == 0 {
+		c.Consecutive5xx = d.Consecutive5xx
+	}
+	if c.ConsecutiveGatewayFailures == 0 {
+		c.ConsecutiveGatewayFailures = d.ConsecutiveGatewayFailures
+	}
+	if c.BaseEjectionTime <= 0 {
+		c.BaseEjectionTime = d.BaseEjectionTime
+	}
+	if c.MaxEjectionTime <= 0 {
+		c.MaxEjectionTime = d.MaxEjectionTime
+	}
+	if c.MaxEjectionPercent == 0 {
+		c.MaxEjectionPercent = d.MaxEjectionPercent
+	}
+	return c
+}
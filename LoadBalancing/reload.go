@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reloader re-reads the config file and applies backend changes, route
+// splits and certificates to the running pools and listeners without
+// dropping requests. Listener, route and
+// pool sets, strategies and timeouts are fixed at startup; changing them
+// needs a restart.
+type Reloader struct {
+	path   string
+	pools  map[string]*LoadBalancer
+	routes map[string]*route
+	certs  map[string]*CertStore
+
+	mu     sync.Mutex
+	config *Config
+}
+
+func NewReloader(config *Config, pools map[string]*LoadBalancer, routers []*Router, certs map[string]*CertStore) *Reloader {
+	routes := make(map[string]*route)
+	for _, router := range routers {
+		for _, rt := range router.routes {
+			routes[rt.name] = rt
+		}
+	}
+	return &Reloader{path: config.path, pools: pools, routes: routes, certs: certs, config: config}
+}
+
+// Reload loads the config file again. An invalid file leaves everything as
+// it was.
+func (rl *Reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	config, err := LoadConfig(rl.path)
+	if err != nil {
+		return err
+	}
+	rl.warnRestartRequired(config)
+
+	old := make(map[string]PoolConfig, len(rl.config.Pools))
+	for _, pool := range rl.config.Pools {
+		old[pool.Name] = pool
+	}
+	for _, pool := range config.Pools {
+		lb, ok := rl.pools[pool.Name]
+		if !ok {
+			continue
+		}
+		config.reloadPool(lb, old[pool.Name], pool)
+	}
+	rl.applySplits(config)
+	rl.reloadCertificates(config)
+	rl.config = config
+	return nil
+}
+
+func (rl *Reloader) reloadCertificates(config *Config) {
+	for _, listener := range config.Listeners {
+		store, ok := rl.certs[listener.Address]
+		if !ok || listener.TLS == nil {
+			continue
+		}
+		if err := store.Load(listener.TLS.Certificates); err != nil {
+			fmt.Printf("Reload: keeping the certificates of %s: %v\n", listener.Address, err)
+		}
+	}
+}
+
+func (rl *Reloader) applySplits(config *Config) {
+	for _, listener := range config.Listeners {
+		for _, rc := range listener.Routes {
+			if rt, ok := rl.routes[rc.Name]; ok && len(rc.Split) > 0 {
+				rt.setSplit(rc.Split)
+			}
+		}
+	}
+}
+
+// withoutReloadable copies listeners with the route splits and certificates
+// left out, which are the parts a reload can change.
+func withoutReloadable(listeners []ListenerConfig) []ListenerConfig {
+	listeners = slices.Clone(listeners)
+	for i := range listeners {
+		if listeners[i].TLS != nil {
+			tlsConfig := *listeners[i].TLS
+			tlsConfig.Certificates = nil
+			listeners[i].TLS = &tlsConfig
+		}
+		listeners[i].Routes = slices.Clone(listeners[i].Routes)
+		for j := range listeners[i].Routes {
+			listeners[i].Routes[j].Split = nil
+		}
+	}
+	return listeners
+}
+
+// changedPoolSettings names the settings that differ between two versions of
+// a pool and that reloadPool can't apply to a running one.
+func changedPoolSettings(old, pool PoolConfig) []string {
+	for _, p := range []*PoolConfig{&old, &pool} {
+		p.Servers, p.HealthCheck, p.Breaker, p.TLS = nil, nil, nil, nil
+		p.LatencyDecay, p.DrainTimeout = 0, 0
+	}
+	a, b := reflect.ValueOf(old), reflect.ValueOf(pool)
+	var changed []string
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			name, _, _ := strings.Cut(a.Type().Field(i).Tag.Get("json"), ",")
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+func (rl *Reloader) warnRestartRequired(config *Config) {
+	if !reflect.DeepEqual(withoutReloadable(config.Listeners), withoutReloadable(rl.config.Listeners)) {
+		fmt.Println("Reload: listener and route changes need a restart and were ignored")
+	}
+	if config.Timeouts != rl.config.Timeouts {
+		fmt.Println("Reload: timeout changes only apply to new servers")
+	}
+	old := make(map[string]PoolConfig, len(rl.config.Pools))
+	for _, pool := range rl.config.Pools {
+		old[pool.Name] = pool
+	}
+	for _, pool := range config.Pools {
+		if _, ok := rl.pools[pool.Name]; !ok {
+			fmt.Printf("Reload: new pool %s needs a restart and was ignored\n", pool.Name)
+			continue
+		}
+		if !reflect.DeepEqual(pool.TLS, old[pool.Name].TLS) {
+			fmt.Printf("Reload: TLS changes to pool %s only apply to new servers\n", pool.Name)
+		}
+		if changed := changedPoolSettings(old[pool.Name], pool); len(changed) > 0 {
+			fmt.Printf("Reload: pool %s: changes to %s need a restart and were ignored\n", pool.Name, strings.Join(changed, ", "))
+		}
+	}
+}
+
+// reloadPool diffs the pool's servers by address. Servers that stay keep
+// their health state and counters; new ones are built from scratch; removed
+// ones stop being selected but finish the requests they already have.
+func (c *Config) reloadPool(lb *LoadBalancer, old, pool PoolConfig) {
+	live := make(map[string]*SimpleServer)
+	for _, server := range lb.Servers() {
+		if s, ok := server.(*SimpleServer); ok {
+			live[s.Address()] = s
+		}
+	}
+
+	healthChanged := !reflect.DeepEqual(old.HealthCheck, pool.HealthCheck)
+	breakerChanged := !reflect.DeepEqual(old.Breaker, pool.Breaker)
+	servers := make([]Server, 0, len(pool.Servers))
+	added := 0
+	for _, sc := range pool.Servers {
+		server, ok := live[sc.Address]
+		if !ok {
+			server, err := c.buildServer(pool, sc)
+			if err != nil {
+				fmt.Printf("Reload: not adding %s: %v\n", sc.Address, err)
+				continue
+			}
+			if lb.outliers != nil {
+				lb.outliers.Attach(server)
+			}
+			servers = append(servers, server)
+			added++
+			continue
+		}
+		delete(live, sc.Address)
+
+		server.SetWeight(sc.weight())
+		server.SetTags(sc.Tags)
+		if pool.LatencyDecay > 0 {
+			server.SetLatencyDecay(pool.LatencyDecay)
+		}
+		if healthChanged {
+			if pool.HealthCheck != nil {
+				server.StartHealthCheck(*pool.HealthCheck)
+			} else {
+				server.StopHealthCheck()
+				server.alive.Store(true)
+			}
+		}
+		if breakerChanged {
+			server.SetBreaker(pool.Breaker)
+		}
+		servers = append(servers, server)
+	}
+
+	lb.SetServers(servers)
+	for _, removed := range live {
+		retireServer(lb, removed, pool.DrainTimeout)
+	}
+	fmt.Printf("Reload: pool %s has %d servers (%d added, %d removed)\n", pool.Name, len(servers), added, len(live))
+}
+
+// retireServer drains a server that was removed from its pool and releases
+// its connections once the last request is done.
+func retireServer(lb *LoadBalancer, s *SimpleServer, drainTimeout time.Duration) {
+	s.Drain(drainTimeout)
+	s.StopHealthCheck()
+	if lb.outliers != nil {
+		lb.outliers.Detach(s)
+	}
+	s.whenDrained(s.transport.CloseIdleConnections)
+}
+
+// WatchSignals reloads on every SIGHUP.
+func (rl *Reloader) WatchSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			rl.reloadAndReport("SIGHUP")
+		}
+	}()
+}
+
+// WatchFile polls the config file and reloads when it changes. fsnotify would
+// save the polling, but it isn't in the standard library.
+func (rl *Reloader) WatchFile(interval time.Duration) {
+	go func() {
+		last := rl.fileStamp()
+		for range time.Tick(interval) {
+			stamp := rl.fileStamp()
+			if stamp == "" || stamp == last {
+				continue
+			}
+			last = stamp
+			rl.reloadAndReport("file change")
+		}
+	}()
+}
+
+// fileStamp sums up the modification times and sizes of the config file and
+// the certificates it uses. It is empty while the config file is missing.
+func (rl *Reloader) fileStamp() string {
+	if _, err := os.Stat(rl.path); err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, path := range append([]string{rl.path}, rl.Config().certificateFiles()...) {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&b, "%s %d %d\n", path, info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return b.String()
+}
+
+func (rl *Reloader) reloadAndReport(reason string) {
+	if err := rl.Reload(); err != nil {
+		fmt.Printf("Reload on %s failed, keeping the current config:\n%v\n", reason, err)
+		return
+	}
+	fmt.Printf("Reload on %s done\n", reason)
+}
+
+// UpdatePool edits one pool's config and applies it like a reload would.
+// When the admin section asks for it, the result is written back to the
+// config file.
+func (rl *Reloader) UpdatePool(name string, update func(*PoolConfig) error) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	lb, ok := rl.pools[name]
+	if !ok {
+		return fmt.Errorf("unknown pool %q", name)
+	}
+	config := rl.config.clone()
+	i := slices.IndexFunc(config.Pools, func(p PoolConfig) bool { return p.Name == name })
+	old := rl.config.Pools[i]
+	if err := update(&config.Pools[i]); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	config.reloadPool(lb, old, config.Pools[i])
+	rl.config = config
+	return config.persist()
+}
+
+// UpdateRoute edits one route's config; only its split takes effect without
+// a restart. Like UpdatePool it persists the result when asked to.
+func (rl *Reloader) UpdateRoute(name string, update func(*RouteConfig) error) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	config := rl.config.clone()
+	var rc *RouteConfig
+	for i := range config.Listeners {
+		for j := range config.Listeners[i].Routes {
+			if config.Listeners[i].Routes[j].Name == name {
+				rc = &config.Listeners[i].Routes[j]
+			}
+		}
+	}
+	rt, ok := rl.routes[name]
+	if !ok || rc == nil {
+		return fmt.Errorf("unknown route %q", name)
+	}
+	if err := update(rc); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	rt.setSplit(rc.Split)
+	rl.config = config
+	return config.persist()
+}
+
+// PersistError is returned for a change that took effect but could not be
+// written back to the config file.
+type PersistError struct {
+	Path string
+	Err  error
+}
+
+func (e *PersistError) Error() string {
+	return fmt.Sprintf("applied, but saving %s failed: %v", e.Path, e.Err)
+}
+
+func (e *PersistError) Unwrap() error {
+	return e.Err
+}
+
+// persist saves an applied change when the admin section asks for it.
+func (c *Config) persist() error {
+	if c.Admin == nil || !c.Admin.Persist || c.path == "" {
+		return nil
+	}
+	if err := c.Save(); err != nil {
+		return &PersistError{Path: c.path, Err: err}
+	}
+	return nil
+}
+
+func (rl *Reloader) Config() *Config {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.config
+}
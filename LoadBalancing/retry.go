@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// RetryConfig lets a failed request be sent again to a different backend.
+// Only refused connections and 502/503 answers are retried, and only for the
+// listed methods; list POST explicitly to retry requests with bodies.
+type RetryConfig struct {
+	Attempts      int           `json:"attempts"`
+	Backoff       time.Duration `json:"backoff"`
+	BudgetPercent float64       `json:"budget_percent"`
+	MinRetries    int           `json:"min_retries"`
+	Methods       []string      `json:"methods"`
+	MaxBodyBytes  int64         `json:"max_body_bytes"`
+}
+
+// maxRetryAttempts bounds retry.attempts; more would only multiply the load
+// on a pool that is already failing.
+const maxRetryAttempts = 10
+
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		Attempts:      2,
+		Backoff:       25 * time.Millisecond,
+		BudgetPercent: 20,
+		MinRetries:    3,
+		Methods:       []string{http.MethodGet, http.MethodHead},
+		MaxBodyBytes:  64 << 10,
+	}
+}
+
+func (c RetryConfig) withDefaults() RetryConfig {
+	d := DefaultRetryConfig()
+	if c.Attempts == 0 {
+		c.Attempts = d.Attempts
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = d.Backoff
+	}
+	if c.BudgetPercent == 0 {
+		c.BudgetPercent = d.BudgetPercent
+	}
+	if c.MinRetries == 0 {
+		c.MinRetries = d.MinRetries
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = d.Methods
+	}
+	if c.MaxBodyBytes == 0 {
+		c.MaxBodyBytes = d.MaxBodyBytes
+	}
+	return c
+}
+
+type RetryPolicy struct {
+	config RetryConfig
+	budget *retryBudget
+}
+
+func NewRetryPolicy(config RetryConfig) *RetryPolicy {
+	config = config.withDefaults()
+	return &RetryPolicy{
+		config: config,
+		budget: &retryBudget{percent: config.BudgetPercent, min: config.MinRetries},
+	}
+}
+
+// prepare counts the request towards the budget and says how many times it
+// may be retried. Bodies are read into memory so they can be sent again; a
+// body over the size limit is streamed instead and the request is not
+// retried.
+func (p *RetryPolicy) prepare(r *http.Request) (retries int, body []byte) {
+	if p == nil {
+		return 0, nil
+	}
+	p.budget.request()
+	if !slices.Contains(p.config.Methods, r.Method) {
+		return 0, nil
+	}
+	if !hasBody(r) {
+		return p.config.Attempts, nil
+	}
+	if r.ContentLength > p.config.MaxBodyBytes {
+		return 0, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, p.config.MaxBodyBytes+1))
+	if err != nil || int64(len(body)) > p.config.MaxBodyBytes {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return 0, nil
+	}
+	return p.config.Attempts, body
+}
+
+// wait sleeps before retry number attempt+1 for a random time up to
+// backoff*2^attempt, so retries from many clients don't line up. The limit
+// stops doubling where it would overflow.
+func (p *RetryPolicy) wait(ctx context.Context, attempt int) bool {
+	limit := int64(math.MaxInt64 - 1)
+	if attempt < 63 && int64(p.config.Backoff) <= limit>>attempt {
+		limit = int64(p.config.Backoff) << attempt
+	}
+	timer := time.NewTimer(time.Duration(rand.Int64N(limit + 1)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+const retryBudgetWindow = 10
+
+// retryBudget allows retries up to percent of the requests seen over the
+// last retryBudgetWindow seconds, and always at least min of them, so a
+// struggling pool doesn't get its load multiplied by retries.
+type retryBudget struct {
+	percent float64
+	min     int
+
+	mu      sync.Mutex
+	buckets [retryBudgetWindow]budgetBucket
+}
+
+type budgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// bucket must be called with b.mu held.
+func (b *retryBudget) bucket(second int64) *budgetBucket {
+	bucket := &b.buckets[second%retryBudgetWindow]
+	if bucket.second != second {
+		*bucket = budgetBucket{second: second}
+	}
+	return bucket
+}
+
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	b.bucket(time.Now().Unix()).requests++
+	b.mu.Unlock()
+}
+
+// withdraw takes one retry from the budget, or reports that none is left.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now().Unix()
+	var requests, retries int
+	for _, bucket := range b.buckets {
+		if bucket.second > now-retryBudgetWindow {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	allowed := max(float64(b.min), float64(requests)*b.percent/100)
+	if float64(retries+1) > allowed {
+		return false
+	}
+	b.bucket(now).retries++
+	return true
+}
+
+// retryTarget picks a backend the request hasn't been sent to yet: the
+// strategy's choice if that is a new one, otherwise the least busy of the
+// rest. Strategies that hash requests would keep returning the same backend.
+func (lb *LoadBalancer) retryTarget(r *http.Request, tried []Server) Server {
+	servers := lb.Servers()
+	if server := lb.strategy.Select(servers, r); server != nil && !slices.Contains(tried, server) {
+		return server
+	}
+	var best Server
+	for _, server := range servers {
+		if !isAvailable(server) || slices.Contains(tried, server) {
+			continue
+		}
+		if best == nil || server.InFlight() < best.InFlight() {
+			best = server
+		}
+	}
+	return best
+}
+
+// hasBody looks at the framing rather than r.Body, which the balancer wraps.
+func hasBody(r *http.Request) bool {
+	return r.ContentLength != 0 || len(r.TransferEncoding) > 0
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable
+}
+
+// retryWriter holds back a 502 or 503 response, up to a size limit, so the
+// request can still be retried elsewhere. Everything else goes straight
+// through. Headers are collected separately until the response is committed
+// so a discarded attempt leaves nothing behind.
+type retryWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	limit  int
+
+	status    int
+	held      bool
+	committed bool
+	body      bytes.Buffer
+}
+
+func newRetryWriter(w http.ResponseWriter, limit int) *retryWriter {
+	return &retryWriter{w: w, header: w.Header().Clone(), limit: limit}
+}
+
+func (rw *retryWriter) Header() http.Header {
+	if rw.committed {
+		return rw.w.Header()
+	}
+	return rw.header
+}
+
+func (rw *retryWriter) WriteHeader(code int) {
+	if code < 200 {
+		rw.copyHeader()
+		rw.w.WriteHeader(code)
+		return
+	}
+	if rw.status != 0 {
+		return
+	}
+	rw.status = code
+	if isRetryableStatus(code) {
+		rw.held = true
+		return
+	}
+	rw.commit()
+}
+
+func (rw *retryWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.held {
+		if rw.body.Len()+len(b) <= rw.limit {
+			return rw.body.Write(b)
+		}
+		if err := rw.release(); err != nil {
+			return 0, err
+		}
+	}
+	return rw.w.Write(b)
+}
+
+func (rw *retryWriter) Flush() {
+	if !rw.held {
+		http.NewResponseController(rw.w).Flush()
+	}
+}
+
+func (rw *retryWriter) Unwrap() http.ResponseWriter {
+	return rw.w
+}
+
+// failed reports whether the attempt ended with a response that was held
+// back and can be thrown away.
+func (rw *retryWriter) failed() bool {
+	return rw.held
+}
+
+// release sends a held-back response after all, when there's no retry.
+func (rw *retryWriter) release() error {
+	if !rw.held {
+		return nil
+	}
+	rw.held = false
+	rw.commit()
+	_, err := rw.w.Write(rw.body.Bytes())
+	rw.body.Reset()
+	return err
+}
+
+func (rw *retryWriter) commit() {
+	rw.copyHeader()
+	rw.committed = true
+	rw.w.WriteHeader(rw.status)
+}
+
+func (rw *retryWriter) copyHeader() {
+	dst := rw.w.Header()
+	for key, values := range rw.header {
+		dst[key] = values
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// retryBackends starts a backend answering 503 and one answering 200 that
+// records the bodies it was sent.
+func retryBackends(t *testing.T) (failing, healthy *SimpleServer, failed *atomic.Int64, bodies chan string) {
+	t.Helper()
+	failed = &atomic.Int64{}
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failed.Add(1)
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("X-From", "a")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(a.Close)
+	bodies = make(chan string, 10)
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+		w.Header().Set("X-From", "b")
+	}))
+	t.Cleanup(b.Close)
+	return NewSimpleServer(a.URL), NewSimpleServer(b.URL), failed, bodies
+}
+
+func TestRetryMovesToAnotherBackend(t *testing.T) {
+	failing, healthy, failed, bodies := retryBackends(t)
+	lb := NewLoadBalancer([]Server{failing, healthy})
+	lb.SetRetry(NewRetryPolicy(RetryConfig{Methods: []string{http.MethodPost}}))
+
+	w := httptest.NewRecorder()
+	lb.serveProxy(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload")))
+	if w.Code != http.StatusOK || w.Header().Get("X-From") != "b" {
+		t.Fatalf("got %d from %q, want 200 from b", w.Code, w.Header().Get("X-From"))
+	}
+	if failed.Load() != 1 {
+		t.Errorf("failing backend got %d requests, want 1", failed.Load())
+	}
+	if body := <-bodies; body != "payload" {
+		t.Errorf("retried body = %q, want %q", body, "payload")
+	}
+}
+
+func TestRetrySkipsBodiesOverLimit(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		failing, healthy, _, bodies := retryBackends(t)
+		lb := NewLoadBalancer([]Server{failing, healthy})
+		lb.SetRetry(NewRetryPolicy(RetryConfig{Methods: []string{http.MethodPost}, MaxBodyBytes: 10}))
+
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", 100)))
+		if chunked {
+			r.ContentLength = -1
+			r.TransferEncoding = []string{"chunked"}
+		}
+		w := httptest.NewRecorder()
+		lb.serveProxy(w, r)
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("X-From") != "a" {
+			t.Errorf("chunked=%v: got %d from %q, want the 503 from a", chunked, w.Code, w.Header().Get("X-From"))
+		}
+		if len(bodies) != 0 {
+			t.Errorf("chunked=%v: request was retried with body %q", chunked, <-bodies)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := &retryBudget{percent: 10, min: 2}
+	for range 50 {
+		budget.request()
+	}
+	allowed := 0
+	for range 10 {
+		if budget.withdraw() {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("budget allowed %d retries for 50 requests at 10%%, want 5", allowed)
+	}
+
+	idle := &retryBudget{percent: 10, min: 2}
+	if !idle.withdraw() || !idle.withdraw() || idle.withdraw() {
+		t.Error("an idle budget should allow exactly min retries")
+	}
+}
+
+func TestRetryWriterDiscardsFailedAttempt(t *testing.T) {
+	w := httptest.NewRecorder()
+	rw := newRetryWriter(w, 1024)
+	rw.Header().Set("X-Attempt", "1")
+	rw.WriteHeader(http.StatusBadGateway)
+	io.WriteString(rw, "bad gateway")
+	if !rw.failed() {
+		t.Fatal("a 502 should be held back")
+	}
+	if w.Header().Get("X-Attempt") != "" || w.Body.Len() != 0 {
+		t.Error("a held-back attempt leaked into the response")
+	}
+
+	rw.release()
+	if w.Code != http.StatusBadGateway || w.Body.String() != "bad gateway" || w.Header().Get("X-Attempt") != "1" {
+		t.Errorf("released response = %d %q, want the held 502", w.Code, w.Body.String())
+	}
+}
+
+func TestRetryWaitWithLongBackoff(t *testing.T) {
+	policy := NewRetryPolicy(RetryConfig{Attempts: maxRetryAttempts, Backoff: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for attempt := range 70 {
+		if policy.wait(ctx, attempt) {
+			t.Fatalf("wait for attempt %d did not stop on a cancelled context", attempt)
+		}
+	}
+}
+
+func TestRetryAttemptsAreBounded(t *testing.T) {
+	_, err := ParseConfig([]byte(`
+listeners:
+  - address: ":8000"
+    pool: p
+pools:
+  - name: p
+    servers:
+      - address: http://a
+    retry:
+      attempts: 1000
+`), false)
+	if err == nil || !strings.Contains(err.Error(), "pools[0].retry.attempts: must be at most") {
+		t.Errorf("error = %v, want attempts to be rejected", err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RouteConfig sends matching requests to a pool. Every condition that is set
+// has to match: Host is exact or a "*.example.com" wildcard, Headers maps a
+// header to its exact value, or to "" to only require it to be present.
+// Routes are tried from the highest Priority down, in file order for equal
+// priorities; requests no route matches go to the listener's own pool.
+//
+// Instead of one Pool a route can Split its traffic between pools by weight,
+// for canary or blue/green releases. A request naming one of those pools in
+// OverrideHeader or OverrideCookie always goes to it.
+type RouteConfig struct {
+	Name       string            `json:"name"`
+	Priority   int               `json:"priority"`
+	Host       string            `json:"host"`
+	PathPrefix string            `json:"path_prefix"`
+	PathRegex  string            `json:"path_regex"`
+	Methods    []string          `json:"methods"`
+	Headers    map[string]string `json:"headers"`
+	Pool       string            `json:"pool"`
+
+	Split          []SplitConfig `json:"split"`
+	OverrideHeader string        `json:"override_header"`
+	OverrideCookie string        `json:"override_cookie"`
+}
+
+type SplitConfig struct {
+	Pool   string `json:"pool"`
+	Weight int    `json:"weight"`
+}
+
+type route struct {
+	name     string
+	priority int
+	host     string
+	prefix   string
+	regex    *regexp.Regexp
+	methods  []string
+	headers  map[string]string
+	lb       *LoadBalancer
+
+	pools          map[string]*LoadBalancer
+	split          atomic.Pointer[[]splitVariant]
+	overrideHeader string
+	overrideCookie string
+}
+
+type splitVariant struct {
+	pool   string
+	weight int
+	lb     *LoadBalancer
+}
+
+// setSplit replaces the route's traffic split; requests already routed are
+// not affected.
+func (rt *route) setSplit(split []SplitConfig) {
+	if len(split) == 0 {
+		rt.split.Store(nil)
+		return
+	}
+	variants := make([]splitVariant, 0, len(split))
+	for _, sc := range split {
+		variants = append(variants, splitVariant{pool: sc.Pool, weight: sc.Weight, lb: rt.pools[sc.Pool]})
+	}
+	rt.split.Store(&variants)
+}
+
+func (rt *route) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	split := rt.split.Load()
+	if split == nil {
+		rt.lb.ServeHTTP(w, r)
+		return
+	}
+	variant := rt.pickVariant(*split, r)
+	recorder := &statusRecorder{ResponseWriter: w}
+	start := time.Now()
+	variant.lb.ServeHTTP(recorder, r)
+	splitRequests.inc(rt.name, variant.pool, statusClass(recorder.status))
+	splitLatency.observe(time.Since(start).Seconds(), rt.name, variant.pool)
+}
+
+func (rt *route) pickVariant(split []splitVariant, r *http.Request) splitVariant {
+	forced := ""
+	if rt.overrideHeader != "" {
+		forced = r.Header.Get(rt.overrideHeader)
+	}
+	if forced == "" && rt.overrideCookie != "" {
+		if cookie, err := r.Cookie(rt.overrideCookie); err == nil {
+			forced = cookie.Value
+		}
+	}
+	total := 0
+	for _, variant := range split {
+		if forced != "" && variant.pool == forced {
+			return variant
+		}
+		total += variant.weight
+	}
+	if total > 0 {
+		n := rand.IntN(total)
+		for _, variant := range split {
+			if n < variant.weight {
+				return variant
+			}
+			n -= variant.weight
+		}
+	}
+	return split[0]
+}
+
+func (rt *route) matches(r *http.Request) bool {
+	if rt.host != "" && !matchHost(rt.host, r.Host) {
+		return false
+	}
+	if rt.prefix != "" && !strings.HasPrefix(r.URL.Path, rt.prefix) {
+		return false
+	}
+	if rt.regex != nil && !rt.regex.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(rt.methods) > 0 && !slices.Contains(rt.methods, r.Method) {
+		return false
+	}
+	for name, value := range rt.headers {
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (value != "" && !slices.Contains(values, value)) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == pattern
+}
+
+// Router picks the pool for each request on one listener.
+type Router struct {
+	listener string
+	routes   []*route
+	fallback *route
+}
+
+func (c *Config) BuildRouter(listener ListenerConfig, pools map[string]*LoadBalancer) (*Router, error) {
+	router := &Router{listener: listener.Address}
+	for i, rc := range listener.Routes {
+		rt := &route{
+			name:     rc.Name,
+			priority: rc.Priority,
+			host:     strings.ToLower(rc.Host),
+			prefix:   rc.PathPrefix,
+			methods:  rc.Methods,
+			headers:  rc.Headers,
+			lb:       pools[rc.Pool],
+
+			pools:          pools,
+			overrideHeader: rc.OverrideHeader,
+			overrideCookie: rc.OverrideCookie,
+		}
+		rt.setSplit(rc.Split)
+		if rt.name == "" {
+			rt.name = fmt.Sprintf("route%d", i)
+		}
+		if rc.PathRegex != "" {
+			regex, err := regexp.Compile(rc.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", rt.name, err)
+			}
+			rt.regex = regex
+		}
+		router.routes = append(router.routes, rt)
+	}
+	slices.SortStableFunc(router.routes, func(a, b *route) int {
+		return cmp.Compare(b.priority, a.priority)
+	})
+	if listener.Pool != "" {
+		router.fallback = &route{name: "default", lb: pools[listener.Pool]}
+	}
+	return router, nil
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt := router.fallback
+	for _, candidate := range router.routes {
+		if candidate.matches(r) {
+			rt = candidate
+			break
+		}
+	}
+	if rt == nil {
+		routeRequests.inc(router.listener, "none")
+		http.NotFound(w, r)
+		return
+	}
+	routeRequests.inc(router.listener, rt.name)
+	if r.TLS != nil {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		r.Header.Set("X-Forwarded-Proto", "http")
+	}
+	forwardClientSubject(r)
+	rt.ServeHTTP(w, r)
+}
+
+func (router *Router) String() string {
+	if len(router.routes) == 0 {
+		if router.fallback == nil {
+			return "no routes"
+		}
+		return "pool " + router.fallback.lb.name
+	}
+	s := fmt.Sprintf("%d routes", len(router.routes))
+	if router.fallback != nil {
+		s += ", default pool " + router.fallback.lb.name
+	}
+	return s
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// shutdown stops accepting connections, waits up to timeout for in-flight
+// requests to finish, then releases upstream connections. Requests still
+// running at the deadline are cut off.
+func shutdown(servers []*http.Server, pools map[string]*LoadBalancer, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(servers))
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+				errs[i] = fmt.Errorf("%s: %w", server.Addr, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, lb := range pools {
+		for _, server := range lb.Servers() {
+			if s, ok := server.(*SimpleServer); ok {
+				s.StopHealthCheck()
+				s.transport.CloseIdleConnections()
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
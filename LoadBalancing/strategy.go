@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Strategy picks the backend for a request. It returns nil when none of the
+// servers can take it.
+type Strategy interface {
+	Select(servers []Server, r *http.Request) Server
+}
+
+func isAvailable(s Server) bool {
+	if ss, ok := s.(*SimpleServer); ok && !ss.breakerAllows() {
+		return false
+	}
+	return s.IsAlive() && !s.Draining()
+}
+
+type RoundRobinStrategy struct {
+	count atomic.Uint64
+}
+
+func NewRoundRobinStrategy() *RoundRobinStrategy {
+	return &RoundRobinStrategy{}
+}
+
+func (rr *RoundRobinStrategy) Select(servers []Server, r *http.Request) Server {
+	for range servers {
+		next := rr.count.Add(1) - 1
+		server := servers[next%uint64(len(servers))]
+		if isAvailable(server) {
+			return server
+		}
+	}
+	return nil
+}
+
+// LeastConnectionsStrategy sends each request to the backend with the fewest
+// requests in flight, so slow backends stop accumulating work.
+type LeastConnectionsStrategy struct {
+	offset atomic.Uint64
+}
+
+func NewLeastConnectionsStrategy() *LeastConnectionsStrategy {
+	return &LeastConnectionsStrategy{}
+}
+
+func (lc *LeastConnectionsStrategy) Select(servers []Server, r *http.Request) Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	// Start the scan at a rotating offset so ties don't all go to servers[0].
+	start := lc.offset.Add(1) - 1
+	var best Server
+	var bestLoad int64
+	for i := range servers {
+		server := servers[(start+uint64(i))%uint64(len(servers))]
+		if !isAvailable(server) {
+			continue
+		}
+		if load := server.InFlight(); best == nil || load < bestLoad {
+			best, bestLoad = server, load
+		}
+	}
+	return best
+}
+
+// WeightedRoundRobinStrategy is nginx's smooth weighted round robin: a server
+// with weight 5 next to one with weight 1 gets five picks out of six, spread
+// out instead of in a burst. Weights are read on every pick, so they can be
+// changed at runtime without resetting the rotation.
+type WeightedRoundRobinStrategy struct {
+	mu      sync.Mutex
+	current map[string]int64
+}
+
+func NewWeightedRoundRobinStrategy() *WeightedRoundRobinStrategy {
+	return &WeightedRoundRobinStrategy{current: make(map[string]int64)}
+}
+
+func (wrr *WeightedRoundRobinStrategy) Select(servers []Server, r *http.Request) Server {
+	wrr.mu.Lock()
+	defer wrr.mu.Unlock()
+
+	if len(wrr.current) > len(servers) {
+		wrr.forgetRemoved(servers)
+	}
+
+	var best Server
+	var total int64
+	for _, server := range servers {
+		weight := int64(server.Weight())
+		if weight <= 0 || !isAvailable(server) {
+			continue
+		}
+		address := server.Address()
+		wrr.current[address] += weight
+		total += weight
+		if best == nil || wrr.current[address] > wrr.current[best.Address()] {
+			best = server
+		}
+	}
+	if best != nil {
+		wrr.current[best.Address()] -= total
+	}
+	return best
+}
+
+func (wrr *WeightedRoundRobinStrategy) forgetRemoved(servers []Server) {
+	present := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		present[server.Address()] = true
+	}
+	for address := range wrr.current {
+		if !present[address] {
+			delete(wrr.current, address)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeServer is a Server with fixed state for exercising strategies
+// without a network.
+type fakeServer struct {
+	address  string
+	dead     bool
+	draining bool
+	inflight int64
+	weight   int
+	latency  time.Duration
+}
+
+func (f *fakeServer) Address() string                          { return f.address }
+func (f *fakeServer) IsAlive() bool                            { return !f.dead }
+func (f *fakeServer) Draining() bool                           { return f.draining }
+func (f *fakeServer) InFlight() int64                          { return f.inflight }
+func (f *fakeServer) Weight() int                              { return f.weight }
+func (f *fakeServer) Latency() time.Duration                   { return f.latency }
+func (f *fakeServer) Serve(http.ResponseWriter, *http.Request) {}
+
+func fakeServers(addresses ...string) []Server {
+	servers := make([]Server, len(addresses))
+	for i, address := range addresses {
+		servers[i] = &fakeServer{address: address, weight: 1}
+	}
+	return servers
+}
+
+func pickCounts(strategy Strategy, servers []Server, n int) map[string]int {
+	counts := make(map[string]int)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for range n {
+		if server := strategy.Select(servers, r); server != nil {
+			counts[server.Address()]++
+		}
+	}
+	return counts
+}
+
+func TestRoundRobinSkipsUnavailable(t *testing.T) {
+	servers := fakeServers("a", "b", "c")
+	servers[1].(*fakeServer).dead = true
+	servers[2].(*fakeServer).draining = true
+
+	counts := pickCounts(NewRoundRobinStrategy(), servers, 10)
+	if counts["a"] != 10 {
+		t.Errorf("picks = %v, want all 10 on a", counts)
+	}
+	servers[0].(*fakeServer).dead = true
+	if server := NewRoundRobinStrategy().Select(servers, nil); server != nil {
+		t.Errorf("Select = %s, want nil with no server available", server.Address())
+	}
+}
+
+func TestLeastConnectionsPicksLeastBusy(t *testing.T) {
+	servers := fakeServers("a", "b", "c")
+	servers[0].(*fakeServer).inflight = 5
+	servers[1].(*fakeServer).inflight = 1
+	servers[2].(*fakeServer).inflight = 3
+
+	counts := pickCounts(NewLeastConnectionsStrategy(), servers, 10)
+	if counts["b"] != 10 {
+		t.Errorf("picks = %v, want all 10 on b", counts)
+	}
+}
+
+func TestLeastConnectionsSpreadsTies(t *testing.T) {
+	servers := fakeServers("a", "b", "c")
+	counts := pickCounts(NewLeastConnectionsStrategy(), servers, 300)
+	for _, address := range []string{"a", "b", "c"} {
+		if counts[address] != 100 {
+			t.Errorf("picks = %v, want 100 each", counts)
+			break
+		}
+	}
+}
+
+func TestWeightedRoundRobinIsSmooth(t *testing.T) {
+	servers := fakeServers("a", "b", "c")
+	servers[0].(*fakeServer).weight = 5
+
+	strategy := NewWeightedRoundRobinStrategy()
+	var picks string
+	for range 7 {
+		picks += strategy.Select(servers, nil).Address()
+	}
+	if want := "aabacaa"; picks != want {
+		t.Errorf("picks = %s, want %s", picks, want)
+	}
+}
+
+func TestWeightedRoundRobinSkipsZeroWeight(t *testing.T) {
+	servers := fakeServers("a", "b")
+	servers[0].(*fakeServer).weight = 0
+	servers[1].(*fakeServer).weight = 2
+
+	counts := pickCounts(NewWeightedRoundRobinStrategy(), servers, 10)
+	if counts["b"] != 10 {
+		t.Errorf("picks = %v, want all 10 on b", counts)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// TLSConfig turns a listener into an HTTPS listener. The certificate is
+// picked by the SNI name the client asks for, falling back to the first
+// pair. Certificates are read again on every config reload.
+//
+// ClientAuth "optional" or "require" checks client certificates against
+// ClientCA; the subject of a verified one is passed to the backends in the
+// X-Client-Cert-Subject header.
+type TLSConfig struct {
+	Certificates []CertificateConfig `json:"certificates"`
+	MinVersion   string              `json:"min_version"`
+	ClientAuth   string              `json:"client_auth"`
+	ClientCA     string              `json:"client_ca"`
+}
+
+type CertificateConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+// clientSubjectHeader carries the subject of a verified client certificate
+// to the backends. Whatever the client sent in it is dropped.
+const clientSubjectHeader = "X-Client-Cert-Subject"
+
+// UpstreamTLSConfig is how a pool talks to its https backends: CA replaces
+// the system roots for verifying them, and Cert/Key is the client
+// certificate presented to backends that ask for one.
+type UpstreamTLSConfig struct {
+	CA         string `json:"ca"`
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	ServerName string `json:"server_name"`
+}
+
+func (c UpstreamTLSConfig) clientConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: c.ServerName}
+	if c.CA != "" {
+		roots, err := loadCertPool(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = roots
+	}
+	if c.Cert != "" {
+		cert, err := loadCertificate(CertificateConfig{Cert: c.Cert, Key: c.Key})
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	return config, nil
+}
+
+// SetUpstreamTLS applies the pool's TLS settings to the server's
+// connections. Connections already open are not affected.
+func (s *SimpleServer) SetUpstreamTLS(config *UpstreamTLSConfig) error {
+	if config == nil {
+		return nil
+	}
+	tlsConfig, err := config.clientConfig()
+	if err != nil {
+		return err
+	}
+	// The transport adjusts the config it is given, so it gets a copy and
+	// health checks can take another one.
+	s.tlsConfig = tlsConfig
+	s.transport.TLSClientConfig = tlsConfig.Clone()
+	return nil
+}
+
+// CertStore serves a listener's certificates and lets them be swapped while
+// connections are being accepted.
+type CertStore struct {
+	config    TLSConfig
+	clientCAs *x509.CertPool
+	certs     atomic.Pointer[certSet]
+}
+
+type certSet struct {
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+func NewCertStore(config TLSConfig) (*CertStore, error) {
+	store := &CertStore{config: config}
+	if config.ClientCA != "" {
+		pool, err := loadCertPool(config.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		store.clientCAs = pool
+	}
+	if err := store.Load(config.Certificates); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Load reads the certificate/key pairs. If any of them is unusable the
+// certificates in use are kept.
+func (s *CertStore) Load(certificates []CertificateConfig) error {
+	set := &certSet{byName: make(map[string]*tls.Certificate)}
+	for _, cc := range certificates {
+		cert, err := loadCertificate(cc)
+		if err != nil {
+			return err
+		}
+		if set.fallback == nil {
+			set.fallback = cert
+		}
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := set.byName[name]; !ok {
+				set.byName[name] = cert
+			}
+		}
+	}
+	if set.fallback == nil {
+		return errors.New("no certificates")
+	}
+	s.certs.Store(set)
+	return nil
+}
+
+func loadCertificate(cc CertificateConfig) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(cc.Cert, cc.Key)
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s: %w", cc.Cert, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("certificate %s: %w", cc.Cert, err)
+		}
+	}
+	return &cert, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return pool, nil
+}
+
+func (s *CertStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := s.certs.Load()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := set.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := set.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return set.fallback, nil
+}
+
+func (s *CertStore) TLSConfig() *tls.Config {
+	minVersion, ok := tlsVersions[s.config.MinVersion]
+	if !ok {
+		minVersion = tls.VersionTLS12
+	}
+	return &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: s.getCertificate,
+		ClientAuth:     clientAuthTypes[s.config.ClientAuth],
+		ClientCAs:      s.clientCAs,
+	}
+}
+
+func forwardClientSubject(r *http.Request) {
+	r.Header.Del(clientSubjectHeader)
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		r.Header.Set(clientSubjectHeader, r.TLS.VerifiedChains[0][0].Subject.String())
+	}
+}
+
+// redirectHTTPS sends clients of a plain listener to the same URL over
+// HTTPS on port.
+func redirectHTTPS(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
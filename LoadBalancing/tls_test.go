@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	path string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	ca := &testCA{t: t, dir: t.TempDir()}
+	ca.key = newTestKey(t)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.cert, _ = x509.ParseCertificate(der)
+	ca.pool = x509.NewCertPool()
+	ca.pool.AddCert(ca.cert)
+	ca.path = filepath.Join(ca.dir, "ca.crt")
+	writePEM(t, ca.path, "CERTIFICATE", der)
+	return ca
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// issue writes a certificate and key for names, or for a client called
+// subject when names is empty, and returns their paths.
+func (ca *testCA) issue(subject string, names ...string) CertificateConfig {
+	ca.t.Helper()
+	key := newTestKey(ca.t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: subject, Organization: []string{"Tests"}},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if len(names) == 0 {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cc := CertificateConfig{
+		Cert: filepath.Join(ca.dir, subject+".crt"),
+		Key:  filepath.Join(ca.dir, subject+".key"),
+	}
+	writePEM(ca.t, cc.Cert, "CERTIFICATE", der)
+	writePEM(ca.t, cc.Key, "EC PRIVATE KEY", keyDER)
+	return cc
+}
+
+func servedName(t *testing.T, store *CertStore, serverName string) string {
+	t.Helper()
+	cert, err := store.getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertStoreSelectsBySNI(t *testing.T) {
+	ca := newTestCA(t)
+	store, err := NewCertStore(TLSConfig{Certificates: []CertificateConfig{
+		ca.issue("a", "a.test", "*.a.test"),
+		ca.issue("b", "b.test"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"b.test":     "b",
+		"B.TEST.":    "b",
+		"www.a.test": "a",
+		"other.test": "a",
+		"":           "a",
+	} {
+		if got := servedName(t, store, name); got != want {
+			t.Errorf("SNI %q got certificate %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestCertStoreReloadKeepsCertificatesOnError(t *testing.T) {
+	ca := newTestCA(t)
+	store, err := NewCertStore(TLSConfig{Certificates: []CertificateConfig{ca.issue("a", "a.test")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Load([]CertificateConfig{ca.issue("c", "a.test")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(t, store, "a.test"); got != "c" {
+		t.Fatalf("after reload got certificate %s, want c", got)
+	}
+
+	broken := ca.issue("d", "a.test")
+	os.WriteFile(broken.Cert, []byte("garbage"), 0o600)
+	if err := store.Load([]CertificateConfig{broken}); err == nil {
+		t.Fatal("loading a broken certificate succeeded")
+	}
+	if got := servedName(t, store, "a.test"); got != "c" {
+		t.Errorf("after a failed reload got certificate %s, want c", got)
+	}
+}
+
+func TestHTTPSListener(t *testing.T) {
+	ca := newTestCA(t)
+	store, err := NewCertStore(TLSConfig{MinVersion: "1.3", Certificates: []CertificateConfig{
+		ca.issue("a", "a.test"),
+		ca.issue("b", "b.test"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, _ := startBackends(t, 1)
+	router := &Router{listener: "test", fallback: &route{name: "default", lb: NewLoadBalancer(servers)}}
+	listener := httptest.NewUnstartedServer(router)
+	listener.TLS = store.TLSConfig()
+	listener.StartTLS()
+	defer listener.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool, ServerName: "b.test"}}}
+	resp, err := client.Get(listener.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.TLS.PeerCertificates[0].Subject.CommonName; got != "b" {
+		t.Errorf("served certificate %s for b.test, want b", got)
+	}
+	if resp.TLS.Version != tls.VersionTLS13 {
+		t.Errorf("negotiated TLS version %x, want 1.3", resp.TLS.Version)
+	}
+
+	old := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool, ServerName: "a.test", MaxVersion: tls.VersionTLS12}}}
+	if _, err := old.Get(listener.URL); err == nil {
+		t.Error("a TLS 1.2 client was accepted with min_version 1.3")
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	for _, tc := range []struct {
+		host string
+		port int
+		want string
+	}{
+		{"shop.test:8080", 8443, "https://shop.test:8443/a?b=c"},
+		{"shop.test", 443, "https://shop.test/a?b=c"},
+		{"[::1]:8080", 8443, "https://[::1]:8443/a?b=c"},
+		{"[::1]:8080", 443, "https://[::1]/a?b=c"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/a?b=c", nil)
+		r.Host = tc.host
+		w := httptest.NewRecorder()
+		redirectHTTPS(tc.port).ServeHTTP(w, r)
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != tc.want {
+			t.Errorf("%s to port %d: got %d %s, want 308 %s", tc.host, tc.port, w.Code, w.Header().Get("Location"), tc.want)
+		}
+	}
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serving := ca.issue("backend", "backend.test")
+	pair, err := tls.LoadX509KeyPair(serving.Cert, serving.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Peer", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	client := ca.issue("lb")
+	server := NewSimpleServer(backend.URL)
+	if err := server.SetUpstreamTLS(&UpstreamTLSConfig{CA: ca.path, Cert: client.Cert, Key: client.Key, ServerName: "backend.test"}); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	server.Serve(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK || w.Header().Get("X-Peer") != "lb" {
+		t.Errorf("got %d with peer %q, want 200 with peer lb", w.Code, w.Header().Get("X-Peer"))
+	}
+
+	anonymous := NewSimpleServer(backend.URL)
+	anonymous.SetUpstreamTLS(&UpstreamTLSConfig{CA: ca.path, ServerName: "backend.test"})
+	w = httptest.NewRecorder()
+	anonymous.Serve(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("without a client certificate got %d, want 502", w.Code)
+	}
+
+	untrusting := NewSimpleServer(backend.URL)
+	untrusting.SetUpstreamTLS(&UpstreamTLSConfig{Cert: client.Cert, Key: client.Key, ServerName: "backend.test"})
+	w = httptest.NewRecorder()
+	untrusting.Serve(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("without the backend CA got %d, want 502", w.Code)
+	}
+}
+
+func TestClientCertificateSubjectIsForwarded(t *testing.T) {
+	ca := newTestCA(t)
+	store, err := NewCertStore(TLSConfig{
+		ClientAuth:   "optional",
+		ClientCA:     ca.path,
+		Certificates: []CertificateConfig{ca.issue("a", "a.test")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subjects := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subjects <- r.Header.Get(clientSubjectHeader)
+	}))
+	defer backend.Close()
+	router := &Router{listener: "test", fallback: &route{name: "default", lb: NewLoadBalancer([]Server{NewSimpleServer(backend.URL)})}}
+	listener := httptest.NewUnstartedServer(router)
+	listener.TLS = store.TLSConfig()
+	listener.StartTLS()
+	defer listener.Close()
+
+	alice := ca.issue("alice")
+	pair, err := tls.LoadX509KeyPair(alice.Cert, alice.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		certs []tls.Certificate
+		want  string
+	}{
+		{"verified", []tls.Certificate{pair}, "CN=alice,O=Tests"},
+		{"anonymous", nil, ""},
+	} {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs: ca.pool, ServerName: "a.test", Certificates: tc.certs,
+		}}}
+		r, _ := http.NewRequest(http.MethodGet, listener.URL, nil)
+		r.Header.Set(clientSubjectHeader, "CN=forged")
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		resp.Body.Close()
+		if got := <-subjects; got != tc.want {
+			t.Errorf("%s: backend saw subject %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}